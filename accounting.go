@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Accounting aggregates traffic in memory and writes it to database in
+// batches, one update per user and backend per flush instead of one per
+// article. Unflushed traffic is lost on crash, so Flush is also called
+// on shutdown.
+type Accounting struct {
+	sync.Mutex
+	ur *UserRepository
+	br *BackendRepository
+
+	users    map[string]int64
+	backends map[string]int64
+	// flushing holds user traffic being written, still counted as pending
+	flushing map[string]int64
+	flush    sync.Mutex
+}
+
+func NewAccounting(ur *UserRepository, br *BackendRepository) *Accounting {
+	return &Accounting{
+		ur:       ur,
+		br:       br,
+		users:    make(map[string]int64),
+		backends: make(map[string]int64),
+		flushing: make(map[string]int64),
+	}
+}
+
+// AddUser accounts bytes downloaded by user.
+func (a *Accounting) AddUser(user string, rx int64) {
+	a.Lock()
+	a.users[user] += rx
+	a.Unlock()
+}
+
+// AddBackend accounts bytes fetched from backend.
+func (a *Accounting) AddBackend(backend string, rx int64) {
+	a.Lock()
+	a.backends[backend] += rx
+	a.Unlock()
+}
+
+// PendingUser returns bytes downloaded by user not flushed yet.
+func (a *Accounting) PendingUser(user string) int64 {
+	a.Lock()
+	defer a.Unlock()
+	return a.users[user] + a.flushing[user]
+}
+
+// Refresh runs refresh of cached usage, e.g. UserRepository.Refresh, while
+// no flush is in progress. Usage read half way through a flush could miss
+// traffic which was already taken off pending counters, quotas would be
+// under-enforced till the next refresh then. Otherwise cached usage plus
+// PendingUser is always the whole usage.
+func (a *Accounting) Refresh(refresh func()) {
+	a.flush.Lock()
+	defer a.flush.Unlock()
+
+	refresh()
+}
+
+// Flush writes aggregated traffic to database, traffic failed to be
+// written stays pending for the next flush.
+func (a *Accounting) Flush() {
+	a.flush.Lock()
+	defer a.flush.Unlock()
+
+	a.Lock()
+	a.flushing, a.users = a.users, make(map[string]int64)
+	users := make(map[string]int64, len(a.flushing))
+	for user, rx := range a.flushing {
+		users[user] = rx
+	}
+	backends := a.backends
+	a.backends = make(map[string]int64)
+	a.Unlock()
+
+	for user, rx := range users {
+		err := a.ur.Stats(user, rx, 0)
+
+		// cached user includes flushed usage now, unless it failed
+		a.Lock()
+		if err != nil {
+			a.users[user] += rx
+		}
+		delete(a.flushing, user)
+		a.Unlock()
+
+		if err != nil {
+			log.Printf("[users] [%s] stats: %v\n", user, err)
+		}
+	}
+
+	for backend, rx := range backends {
+		if err := a.br.Stats(backend, rx); err != nil {
+			log.Printf("[backends] [%s] stats: %v\n", backend, err)
+
+			a.Lock()
+			a.backends[backend] += rx
+			a.Unlock()
+		}
+	}
+}
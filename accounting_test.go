@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestAccounting(t *testing.T) (*Accounting, *UserRepository, *fakeDb) {
+	db, fd := newFakeDb(t)
+	ur := &UserRepository{db: db, users: map[string]User{"u": {Name: "u"}}}
+
+	return NewAccounting(ur, &BackendRepository{db: db}), ur, fd
+}
+
+func TestAccountingFlush(t *testing.T) {
+	ua, ur, fd := newTestAccounting(t)
+
+	ua.AddUser("u", 100)
+	ua.AddUser("u", 50)
+	ua.AddBackend("b", 150)
+	if pending := ua.PendingUser("u"); pending != 150 {
+		t.Fatalf("expected 150 pending bytes, got %d", pending)
+	}
+
+	ua.Flush()
+
+	if fd.executed() != 2 {
+		t.Errorf("expected single update per user and backend, got %d", fd.executed())
+	}
+	if pending := ua.PendingUser("u"); pending != 0 {
+		t.Errorf("expected nothing pending after flush, got %d", pending)
+	}
+	if u := ur.Get("u"); u.RxBytes != 150 || u.PeriodBytes != 150 {
+		t.Errorf("flushed traffic not cached, got %d, %d", u.RxBytes, u.PeriodBytes)
+	}
+}
+
+func TestAccountingFlushFailed(t *testing.T) {
+	ua, ur, fd := newTestAccounting(t)
+	fd.err = errors.New("database is down")
+
+	ua.AddUser("u", 100)
+	ua.AddBackend("b", 100)
+	ua.Flush()
+
+	if pending := ua.PendingUser("u"); pending != 100 {
+		t.Errorf("expected failed traffic pending, got %d", pending)
+	}
+	if u := ur.Get("u"); u.PeriodBytes != 0 {
+		t.Errorf("failed traffic cached, got %d", u.PeriodBytes)
+	}
+
+	// written with the next flush
+	fd.err = nil
+	ua.Flush()
+
+	if pending := ua.PendingUser("u"); pending != 0 {
+		t.Errorf("expected nothing pending after flush, got %d", pending)
+	}
+	if u := ur.Get("u"); u.PeriodBytes != 100 {
+		t.Errorf("expected flushed traffic cached, got %d", u.PeriodBytes)
+	}
+	if len(ua.backends) != 0 {
+		t.Errorf("backend traffic left pending, got %v", ua.backends)
+	}
+}
+
+func TestAccountingRefreshDuringFlush(t *testing.T) {
+	ua, _, fd := newTestAccounting(t)
+	ua.AddUser("u", 100)
+
+	writing, release := make(chan struct{}), make(chan struct{})
+	fd.onExec = func() {
+		close(writing)
+		<-release
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		ua.Flush()
+		close(flushed)
+	}()
+	<-writing
+	fd.Lock()
+	fd.onExec = nil
+	fd.Unlock()
+
+	// traffic being written is still pending
+	if pending := ua.PendingUser("u"); pending != 100 {
+		t.Errorf("expected 100 pending bytes during flush, got %d", pending)
+	}
+
+	refreshed := make(chan struct{})
+	go ua.Refresh(func() {
+		close(refreshed)
+	})
+
+	select {
+	case <-refreshed:
+		t.Fatal("refreshed during flush")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-flushed
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("not refreshed after flush")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"nntplexer/nntp/nntpserver"
+	"path"
+)
+
+// initAdmin registers admin endpoints next to metrics on the monitoring
+// server. Requests need the configured admin token as a bearer token,
+// endpoints are left out when there is none, metrics stay open.
+func initAdmin(config *MonitoringConfig, server *nntpserver.Server, br *BackendRepository) {
+	if config.AdminToken == "" {
+		log.Println("[admin] no admin token configured, admin endpoints disabled")
+		return
+	}
+
+	prefix := path.Join(path.Dir(config.Endpoint), "admin")
+	handle := func(pattern string, handler http.HandlerFunc) {
+		http.Handle(path.Join(prefix, pattern), adminAuth(config.AdminToken, handler))
+	}
+
+	// GET lists backends used by this node, credentials left out
+	handle("backends", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		backends := make([]adminBackend, 0, len(br.Get()))
+		for _, be := range br.Get() {
+			backends = append(backends, adminBackend{
+				Name:      be.Name,
+				Host:      be.Host,
+				Port:      be.Port,
+				UseTLS:    be.UseTLS,
+				Priority:  be.Priority,
+				Retention: be.Retention,
+				MaxConns:  be.MaxConns,
+				Node:      be.Node,
+				Tags:      be.Tags,
+				Overview:  be.Overview,
+			})
+		}
+
+		writeJson(w, struct {
+			Node     uint32         `json:"node"`
+			Backends []adminBackend `json:"backends"`
+		}{br.Node(), backends})
+	})
+
+	// GET lists recent authentication failures and lockouts,
+	// DELETE ?ip=...&user=... clears them
+	handle("lockouts", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, server.Lockouts())
+		case http.MethodDelete:
+			ip, user := r.URL.Query().Get("ip"), r.URL.Query().Get("user")
+			if ip == "" && user == "" {
+				http.Error(w, "ip or user required", http.StatusBadRequest)
+				return
+			}
+			if !server.ClearLockout(ip, user) {
+				http.Error(w, "no lockout found", http.StatusNotFound)
+				return
+			}
+			log.Printf("[admin] lockout cleared, ip: %q, user: %q\n", ip, user)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// adminAuth lets through requests carrying token in Authorization header.
+func adminAuth(token string, handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// adminBackend is a backend as listed by admin endpoint.
+type adminBackend struct {
+	Name      string `json:"name"`
+	Host      string `json:"host"`
+	Port      uint16 `json:"port"`
+	UseTLS    bool   `json:"use_tls"`
+	Priority  uint16 `json:"priority"`
+	Retention uint16 `json:"retention"`
+	MaxConns  uint16 `json:"max_conns"`
+	Node      string `json:"node"`
+	Tags      string `json:"tags"`
+	Overview  bool   `json:"overview"`
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[admin] %v\n", err)
+	}
+}
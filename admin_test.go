@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	handler := adminAuth("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, c := range []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/lockouts?ip=127.0.0.1", nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%q: expected %d, got %d", c.auth, c.code, w.Code)
+		}
+	}
+}
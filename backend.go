@@ -1,20 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
+	"bufio"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"io"
-	"io/ioutil"
 	"log"
-	"net"
 	"net/textproto"
 	"nntplexer/metrics"
+	"nntplexer/nntp"
+	"nntplexer/nntp/nntpclient"
 	"strconv"
 	"time"
-	"strings"
 )
 
 var (
@@ -32,14 +30,63 @@ var (
 type NNTPBackend struct {
 	ur *UserRepository
 	br *BackendRepository
-	ar *ArticleRepository
+	ad *ArticleDates
 	pp *PoolProvider
+	rt *Router
+	mc *MissingCache
+	lc *ListCache
+	ac ArticleCache
+	ua *Accounting
+	pc *PasswordCache
+
+	// headLookup enables fetching headers of articles with unknown
+	// post date, so that retention limited backends can be skipped
+	headLookup bool
+	// retries is how many times a request failing on a broken
+	// connection is retried on the same backend before moving on
+	retries int
+
+	// hedging asks the next backend as well when the current one
+	// doesn't answer within hedgeDelay or hedgePercentile of its
+	// recent latencies, at most hedgeMax backends at once
+	hedgeDelay      time.Duration
+	hedgePercentile float64
+	hedgeMax        int
+
+	// primary is the backend serving group commands and articles
+	// by number, these can't fail over as numbering differs between
+	// backends, empty means the first backend by priority
+	primary string
 }
 
 func (b *NNTPBackend) Authenticate(user string, pass string) bool {
 	u := b.ur.Get(user)
-	h := sha256.Sum256([]byte(pass))
-	return hex.EncodeToString(h[:]) == u.Pass
+	if u.Name == "" {
+		return false
+	}
+
+	if b.pc.Check(user, u.Pass, pass) {
+		return true
+	}
+
+	ok, legacy := CheckPassword(u.Pass, pass)
+	if !ok {
+		return false
+	}
+
+	if legacy {
+		// replace unsalted hash now that password is known
+		if err := b.ur.SetPassword(user, pass); err != nil {
+			log.Printf("[backend] [%s] password upgrade: %v\n", user, err)
+		} else {
+			log.Printf("[backend] [%s] password upgraded\n", user)
+		}
+		return true
+	}
+
+	b.pc.Add(user, u.Pass, pass)
+
+	return true
 }
 
 func (b *NNTPBackend) CheckConnLimit(user string, conns int) bool {
@@ -70,222 +117,454 @@ func (b *NNTPBackend) Greeting() string {
 	return "201 Hi!"
 }
 
-func (b *NNTPBackend) Article(messageId string) (textproto.MIMEHeader, io.Reader, error) {
+func (b *NNTPBackend) Article(messageId string) (textproto.MIMEHeader, io.ReadCloser, error) {
 	metrics.ArticleRequests.Inc()
 
-	backends := b.br.Get()
-	if len(backends) == 0 {
-		log.Println("[backend] No backends found")
-		return nil, nil, &textproto.Error{Code: 403, Msg: "Something went wrong"}
-	}
-
-	for _, be := range backends {
-////		if !strings.Contains(messageId, "-newzNZB-") && !strings.Contains(messageId, "astraweb") && !strings.Contains(messageId, "easyusenet") && !strings.Contains(messageId, "camelsystem-powerpost.local") && !strings.Contains(messageId, "@nyuu") && !strings.Contains(messageId, "@PRiVATE") && strings.Contains(be.Name, "ninja") {
-//			log.Printf("skipping [backend] [%s] skipping %v\n", be.Name, messageId)
-//			pool.Return(po)
-////			continue
-////		}
-		if strings.Contains(messageId, "giganews") && strings.Contains(be.Name, "giga") {
-//			log.Printf("skipping [backend] [%s] skipping %v\n", be.Name, messageId)
-//			pool.Return(po)
-			continue
-		}
-		if strings.Contains(messageId, "xsnews") && strings.Contains(be.Name, "xsnews") {
-//			log.Printf("skipping [backend] [%s] skipping %v\n", be.Name, messageId)
-//			pool.Return(po)
-			continue
-		}
-		pool := b.pp.GetPool(be)
-		po, err := pool.Get()
-		if err != nil {
-			log.Printf("[backend] [%s] pool.Get: %v\n", be.Name, err)
-			continue
-		}
+	return b.cached("article", messageId, func(c *nntpclient.Client) (*nntp.Article, error) {
+		return c.Article(messageId)
+	})
+}
 
-		c := po.object
-		
-		article, err := c.Article(messageId)
-		if err != nil {
-			log.Printf("[backend] [%s] c.Article: %v\n", be.Name, err)
-			log.Printf("[backend] [%s] c.Article: %v\n", be.Name, messageId)
-
-			// handle common protocol errors
-			if tperr, ok := err.(*textproto.Error); ok {
-				metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": strconv.Itoa(tperr.Code)}).Inc()
-
-				switch tperr.Code {
-				case 430:
-					// article not found
-					// try next backend
-					pool.Return(po)
-					continue
-				case 400:
-					// service not available or no longer available (the server
-					// immediately closes the connection).
-					// invalidate (close) connection
-					// try next backend
-					po.Invalidate()
-					pool.Return(po)
-					continue
-				}
-			}
+func (b *NNTPBackend) Body(messageId string) (textproto.MIMEHeader, io.ReadCloser, error) {
+	metrics.ArticleRequests.Inc()
 
-			if _, ok := err.(net.Error); ok {
-				// FIXME: retry with another connection from this pool
-				// net error, drop conn
-				po.Invalidate()
-			}
+	return b.cached("body", messageId, func(c *nntpclient.Client) (*nntp.Article, error) {
+		return c.Body(messageId)
+	})
+}
 
-			metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": "0"}).Inc()
+func (b *NNTPBackend) Head(messageId string) (textproto.MIMEHeader, error) {
+	metrics.ArticleRequests.Inc()
 
-			pool.Return(po)
-			continue
-		}
+	result, err := b.fetch("head", messageId, func(c *nntpclient.Client) (interface{}, error) {
+		return c.Head(messageId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	headers := result.(textproto.MIMEHeader)
+	b.saveDate(messageId, headers)
 
-		metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": "220"}).Inc()
+	return headers, nil
+}
 
-//disabled		if err := b.parseDate(messageId, article.Headers); err != nil {
-//disabled			log.Printf("[backend] [%s] parseDate: %v\n", be.Name, err)
-//disabled		}
+func (b *NNTPBackend) Stat(messageId string) error {
+	metrics.ArticleRequests.Inc()
 
-		body, err := ioutil.ReadAll(article.Body)
+	_, err := b.fetch("stat", messageId, func(c *nntpclient.Client) (interface{}, error) {
+		return nil, c.Stat(messageId)
+	})
+	return err
+}
+
+// fetch runs request against backends in priority order until one of them
+// succeeds. Connection is returned to its pool once request is done.
+func (b *NNTPBackend) fetch(cmd string, messageId string, request request) (interface{}, error) {
+	a, err := b.acquire(cmd, messageId, request, true)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.BackendRequests.With(prometheus.Labels{"backend": a.be.Name, "code": strconv.Itoa(a.po.object.GetCode())}).Inc()
+
+	// response fully read, return conn to pool
+	a.pool.Return(a.po)
+
+	return a.result, nil
+}
+
+// cached serves article from cache, falling back to backends. Articles
+// fetched from backends are stored in cache while streamed to the client.
+func (b *NNTPBackend) cached(cmd string, messageId string, open func(c *nntpclient.Client) (*nntp.Article, error)) (textproto.MIMEHeader, io.ReadCloser, error) {
+	if b.ac == nil {
+		return b.stream(cmd, messageId, open)
+	}
+
+	if headers, body, ok := b.ac.Get(cmd, messageId); ok {
+		return headers, body, nil
+	}
+
+	headers, body, err := b.stream(cmd, messageId, open)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// body only entries are stored without headers
+	var cacheHeaders textproto.MIMEHeader
+	if cmd == "article" {
+		cacheHeaders = headers
+	}
+
+	return headers, newCacheReader(b.ac, messageId, cacheHeaders, body), nil
+}
+
+// stream opens article on the first backend having it and returns its body
+// read straight from backend connection. Failover is only possible until the
+// first byte of body arrives, the connection stays checked out till the
+// returned reader is closed.
+func (b *NNTPBackend) stream(cmd string, messageId string, open func(c *nntpclient.Client) (*nntp.Article, error)) (textproto.MIMEHeader, io.ReadCloser, error) {
+	a, err := b.acquire(cmd, messageId, opening(open), false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metrics.BackendRequests.With(prometheus.Labels{"backend": a.be.Name, "code": strconv.Itoa(a.po.object.GetCode())}).Inc()
+
+	article := a.result.(*nntp.Article)
+	if cmd == "article" {
+		b.saveDate(messageId, article.Headers)
+	}
+
+	return article.Headers, b.reader(a), nil
+}
+
+// opening makes request opening article with open, which waits for the
+// body to start coming, so that a connection dying right after the
+// status line still fails over.
+func opening(open func(c *nntpclient.Client) (*nntp.Article, error)) request {
+	return func(c *nntpclient.Client) (interface{}, error) {
+		article, err := open(c)
 		if err != nil {
-			// there were some problems with reading article
-			// invalidate (close) connection
-			// try next backend
-			po.Invalidate()
-			pool.Return(po)
-			continue
+			return nil, err
 		}
 
-		metrics.BackendBytes.With(prometheus.Labels{"backend": be.Name}).Add(float64(len(body)))
-
-		// article fully read, return conn to pool
-		pool.Return(po)
+		body := bufio.NewReader(article.Body)
+		if _, err := body.Peek(1); err != nil && err != io.EOF {
+			return nil, err
+		}
 
-		return article.Headers, bytes.NewReader(body), nil
+		return &nntp.Article{Headers: article.Headers, Body: body}, nil
 	}
+}
 
-	return nil, nil, &textproto.Error{Code: 430, Msg: "Article not found"}
+// reader returns body of article opened by attempt.
+func (b *NNTPBackend) reader(a *attempt) io.ReadCloser {
+	return &articleReader{
+		Reader:  a.result.(*nntp.Article).Body,
+		backend: a.be.Name,
+		pool:    a.pool,
+		po:      a.po,
+		ua:      b.ua,
+	}
 }
 
-func (b *NNTPBackend) Body(messageId string) (textproto.MIMEHeader, io.Reader, error) {
-	metrics.ArticleRequests.Inc()
+// request runs a command on a backend connection and returns its result.
+type request func(c *nntpclient.Client) (interface{}, error)
 
+// attempt is a request which succeeded, its connection is checked out.
+type attempt struct {
+	be     Backend
+	pool   *ClientPool
+	po     *PooledObject
+	result interface{}
+}
+
+// acquire runs request against backends in priority order until one of them
+// succeeds. Missing articles and broken connections fail over to the next
+// backend. On success the connection is left checked out, it's up to the
+// caller to return it to the pool. Complete tells whether request reads
+// the whole response, so that connections of hedged requests which lost
+// can be reused.
+func (b *NNTPBackend) acquire(cmd string, messageId string, request request, complete bool) (*attempt, error) {
 	backends := b.br.Get()
 	if len(backends) == 0 {
 		log.Println("[backend] No backends found")
-		return nil, nil, &textproto.Error{Code: 403, Msg: "Something went wrong"}
+		return nil, &textproto.Error{Code: 403, Msg: "Something went wrong"}
 	}
 
-	for _, be := range backends {
-		if !strings.Contains(messageId, "-newzNZB-") && !strings.Contains(messageId, "astraweb") && !strings.Contains(messageId, "easyusenet") && !strings.Contains(messageId, "camelsystem-powerpost.local") && !strings.Contains(messageId, "@nyuu") && !strings.Contains(messageId, "@PRiVATE") && strings.Contains(be.Name, "ninja") {
-//			log.Printf("skipping [backend] [%s] skipping %v\n", be.Name, messageId)
-//			pool.Return(po)
-			continue
-		}
-		if strings.Contains(messageId, "giganews") && strings.Contains(be.Name, "giga") {
-//			log.Printf("skipping [backend] [%s] skipping %v\n", be.Name, messageId)
-//			pool.Return(po)
+	if b.missing("", messageId) {
+		return nil, &textproto.Error{Code: 430, Msg: "No such article"}
+	}
+
+	route := b.rt.Route(cmd, messageId, backends)
+	route = b.rt.Retain(route, b.postDate(cmd, messageId, route))
+
+	// number of backends known not to have the article
+	notFound := 0
+
+	candidates := make([]Backend, 0, len(route))
+	for _, be := range route {
+		if b.missing(be.Name, messageId) {
+			metrics.BackendSkips.With(prometheus.Labels{"backend": be.Name, "reason": "missing"}).Inc()
+			notFound++
 			continue
 		}
-		if strings.Contains(messageId, "xsnews") && strings.Contains(be.Name, "xsnews") {
-//			log.Printf("skipping [backend] [%s] skipping %v\n", be.Name, messageId)
-//			pool.Return(po)
-			continue
+		candidates = append(candidates, be)
+	}
+
+	var a *attempt
+	if b.hedging() {
+		a = b.hedge(cmd, messageId, candidates, request, complete, &notFound)
+	} else {
+		for _, be := range candidates {
+			var err error
+			if a, err = b.try(be, cmd, messageId, request); err == nil {
+				break
+			}
+
+			if tperr, ok := err.(*textproto.Error); ok && tperr.Code == 430 {
+				notFound++
+			}
 		}
-		pool := b.pp.GetPool(be)
+	}
+	if a != nil {
+		return a, nil
+	}
+
+	// every backend was asked and none has the article, routing
+	// may differ between commands though, so only remember the
+	// article as missing everywhere when no backend was left out
+	if notFound == len(backends) {
+		b.mc.Add("", messageId)
+	}
+
+	return nil, &textproto.Error{Code: 430, Msg: "No such article"}
+}
+
+// try runs request on backend, retrying with another connection when
+// the one used breaks. Protocol errors are returned right away.
+func (b *NNTPBackend) try(be Backend, cmd string, messageId string, request request) (*attempt, error) {
+	pool, ok := b.pp.GetPool(be.Name)
+	if !ok {
+		// backend was removed since request started
+		b.rt.Observe(be.Name, OutcomeFailed, 0)
+		log.Printf("[backend] [%s] pool.Get: %v\n", be.Name, errPoolNotFound)
+		return nil, errPoolNotFound
+	}
+
+	for attempts := 0; ; attempts++ {
 		po, err := pool.Get()
 		if err != nil {
+			// busy or failing pool, let the load shift elsewhere
+			b.rt.Observe(be.Name, OutcomeFailed, 0)
 			log.Printf("[backend] [%s] pool.Get: %v\n", be.Name, err)
-			continue
+			return nil, err
 		}
 
-		c := po.object
+		start := time.Now()
+		result, err := request(po.object)
+		if err == nil {
+			b.rt.Observe(be.Name, OutcomeOk, time.Since(start))
+			return &attempt{be: be, pool: pool, po: po, result: result}, nil
+		}
 
-		article, err := c.Body(messageId)
-		if err != nil {
-//			log.Printf("[backend] [%s] c.Body: %v\n", be.Name, err)
-//			log.Printf("[backend] [%s] c.Body: %v\n", be.Name, messageId)
-
-			// handle common protocol errors
-			if tperr, ok := err.(*textproto.Error); ok {
-				metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": strconv.Itoa(tperr.Code)}).Inc()
-
-				switch tperr.Code {
-				case 430:
-					// article not found
-					// try next backend
-					pool.Return(po)
-					continue
-				case 400:
-					// service not available or no longer available (the server
-					// immediately closes the connection).
-					// invalidate (close) connection
-					// try next backend
-					po.Invalidate()
-					pool.Return(po)
-					continue
-				}
+		if err == errNoOverview {
+			// backend is fine, it just lacks an optional feature
+			pool.Return(po)
+			return nil, err
+		}
+
+		// handle common protocol errors
+		if tperr, ok := err.(*textproto.Error); ok {
+			if isNotFound(tperr.Code) {
+				b.rt.Observe(be.Name, OutcomeMissing, time.Since(start))
+			} else {
+				b.rt.Observe(be.Name, OutcomeFailed, 0)
 			}
 
-			if _, ok := err.(net.Error); ok {
-				// FIXME: retry with another connection from this pool
-				// net error, drop conn
+			metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": strconv.Itoa(tperr.Code)}).Inc()
+
+			switch tperr.Code {
+			case 400:
+				// service not available or no longer available (the server
+				// immediately closes the connection).
+				// invalidate (close) connection
 				po.Invalidate()
+			case 430:
+				// article not found
+				if messageId != "" {
+					b.mc.Add(be.Name, messageId)
+				}
+			case 411, 420, 421, 422, 423:
+				// no such group, or no such article in the group
+			default:
+				log.Printf("[backend] [%s] %s %s: %v\n", be.Name, cmd, messageId, err)
 			}
 
-			metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": "0"}).Inc()
-
+			// try next backend
 			pool.Return(po)
-			continue
+			return nil, err
 		}
 
-		metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": "220"}).Inc()
+		// net error, timeout or the response was cut in the middle,
+		// either way connection state is unknown, drop conn
+		b.rt.Observe(be.Name, OutcomeFailed, 0)
+		log.Printf("[backend] [%s] %s %s: %v\n", be.Name, cmd, messageId, err)
+		po.Invalidate()
+		countTimeout(be.Name, err)
 
-//disabled		if err := b.parseDate(messageId, article.Headers); err != nil {
-//disabled			log.Printf("[backend] [%s] parseDate: %v\n", be.Name, err)
-//disabled		}
+		metrics.BackendRequests.With(prometheus.Labels{"backend": be.Name, "code": "0"}).Inc()
 
-		body, err := ioutil.ReadAll(article.Body)
-		if err != nil {
-			// there were some problems with reading article
-			// invalidate (close) connection
-			// try next backend
-			po.Invalidate()
-			pool.Return(po)
-			continue
+		pool.Return(po)
+
+		// broken idle socket says nothing about the article,
+		// give the backend another chance with a different connection
+		if attempts >= b.retries {
+			return nil, err
 		}
+		metrics.BackendRetries.With(prometheus.Labels{"backend": be.Name}).Inc()
+	}
+}
+
+// isNotFound tells whether code means the requested article or group
+// doesn't exist, as opposed to the backend failing to serve it.
+func isNotFound(code int) bool {
+	switch code {
+	case 411, 420, 421, 422, 423, 430:
+		return true
+	}
+	return false
+}
 
-		metrics.BackendBytes.With(prometheus.Labels{"backend": be.Name}).Add(float64(len(body)))
+// missing checks negative cache whether article is known to be missing
+// on backend, empty backend stands for all backends.
+func (b *NNTPBackend) missing(backend string, messageId string) bool {
+	if !b.mc.Enabled() {
+		return false
+	}
 
-		// article fully read, return conn to pool
-		pool.Return(po)
+	scope := "backend"
+	if backend == "" {
+		scope = "all"
+	}
+
+	if b.mc.Missing(backend, messageId) {
+		metrics.MissingCacheLookups.With(prometheus.Labels{"scope": scope, "result": "hit"}).Inc()
+		return true
+	}
+
+	metrics.MissingCacheLookups.With(prometheus.Labels{"scope": scope, "result": "miss"}).Inc()
+	return false
+}
+
+// articleReader is an article body being read from a pooled connection.
+type articleReader struct {
+	io.Reader
+	backend string
+	pool    *ClientPool
+	po      *PooledObject
+	ua      *Accounting
+	bytes   int64
+	eof     bool
+	closed  bool
+}
+
+func (r *articleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.bytes += int64(n)
+
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil {
+		log.Printf("[backend] [%s] read: %v\n", r.backend, err)
+		r.po.Invalidate()
+		countTimeout(r.backend, err)
+	}
+
+	return n, err
+}
+
+// Close returns connection to the pool. Body which wasn't read till
+// the terminating dot leaves connection in the middle of a response,
+// so such connection is dropped.
+func (r *articleReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	if !r.eof {
+		r.po.Invalidate()
+	}
+
+	metrics.BackendBytes.With(prometheus.Labels{"backend": r.backend}).Add(float64(r.bytes))
+	r.ua.AddBackend(r.backend, r.bytes)
+
+	r.pool.Return(r.po)
+
+	return nil
+}
+
+// countTimeout records backend timeout, if err is one.
+func countTimeout(backend string, err error) {
+	var te *nntpclient.TimeoutError
+	if errors.As(err, &te) {
+		metrics.BackendTimeouts.With(prometheus.Labels{"backend": backend, "op": te.Op}).Inc()
+	}
+}
+
+// postDate returns known post date of an article or zero time if it's
+// unknown. Date is only looked up when there are retention limited
+// backends in route, otherwise it makes no difference.
+func (b *NNTPBackend) postDate(cmd string, messageId string, route []Backend) time.Time {
+	if !hasRetention(route) {
+		return time.Time{}
+	}
+
+	if date, ok := b.ad.Date(messageId); ok {
+		return date
+	}
 
-		return article.Headers, bytes.NewReader(body), nil
+	if !b.headLookup || cmd == "head" {
+		return time.Time{}
 	}
 
-	return nil, nil, &textproto.Error{Code: 430, Msg: "Body not found"}
+	result, err := b.fetch("head", messageId, func(c *nntpclient.Client) (interface{}, error) {
+		return c.Head(messageId)
+	})
+	if err != nil {
+		return time.Time{}
+	}
+
+	headers := result.(textproto.MIMEHeader)
+
+	b.saveDate(messageId, headers)
+
+	date, _ := parseDate(messageId, headers)
+	return date
 }
 
-func (b *NNTPBackend) parseDate(id string, headers textproto.MIMEHeader) error {
+// saveDate queues article post date for storing, only needed when
+// some backends have limited retention.
+func (b *NNTPBackend) saveDate(messageId string, headers textproto.MIMEHeader) {
+	if !hasRetention(b.br.Get()) {
+		return
+	}
+
+	date, err := parseDate(messageId, headers)
+	if err != nil {
+		log.Printf("[backend] parseDate: %v\n", err)
+		return
+	}
+	b.ad.Add(messageId, date)
+}
+
+func parseDate(id string, headers textproto.MIMEHeader) (time.Time, error) {
 	date := headers.Get("Date")
 	if date == "" {
-		return fmt.Errorf("article: %s missing 'Date' header", id)
+		return time.Time{}, fmt.Errorf("article: %s missing 'Date' header", id)
 	}
 	for _, dateFormat := range dateFormats {
 		ts, err := time.Parse(dateFormat, date)
 		if err == nil {
 			// date was parsed succesfuly
-			// saving
-			_ = b.ar.Create(id, ts)
-			return nil
+			return ts, nil
 		}
 	}
-	return fmt.Errorf("article: %s unknown date format: %s", id, date)
+	return time.Time{}, fmt.Errorf("article: %s unknown date format: %s", id, date)
+}
+
+// CheckQuota tells whether user may still download.
+func (b *NNTPBackend) CheckQuota(user string) bool {
+	u := b.ur.Get(user)
+	if u.Quota == 0 {
+		return true
+	}
+
+	return u.PeriodBytes+uint64(b.ua.PendingUser(user)) < u.Quota
 }
 
 func (b *NNTPBackend) Stats(user string, rx int64, tx int64) {
-//disabled	b.ur.Stats(user, rx, tx)
-//disabled	b.br.Stats("", tx, rx) // FIXME
+	b.ua.AddUser(user, rx)
 }
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"nntplexer/nntp"
+	"nntplexer/nntp/nntpclient"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBackend(retries int) (*NNTPBackend, Backend) {
+	be := Backend{Name: "test"}
+
+	pp := NewPoolProvider()
+	pp.pools[be.Name] = newTestPool(2, 0, 0)
+
+	return &NNTPBackend{
+		pp:      pp,
+		rt:      &Router{stats: NewBackendStats(time.Minute)},
+		mc:      NewMissingCache(time.Minute, 100),
+		retries: retries,
+	}, be
+}
+
+func TestTryRetry(t *testing.T) {
+	b, be := newTestBackend(1)
+
+	var used []*nntpclient.Client
+	a, err := b.try(be, "body", "<a@b>", func(c *nntpclient.Client) (interface{}, error) {
+		used = append(used, c)
+		if len(used) == 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.pool.Return(a.po)
+
+	if len(used) != 2 || used[0] == used[1] {
+		t.Errorf("expected retry with another connection, got %d attempts", len(used))
+	}
+}
+
+func TestTryRetriesExhausted(t *testing.T) {
+	b, be := newTestBackend(2)
+
+	attempts := 0
+	_, err := b.try(be, "body", "<a@b>", func(c *nntpclient.Client) (interface{}, error) {
+		attempts++
+		return nil, io.ErrUnexpectedEOF
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestTryNoRetryOnProtocolError(t *testing.T) {
+	b, be := newTestBackend(1)
+
+	attempts := 0
+	_, err := b.try(be, "body", "<a@b>", func(c *nntpclient.Client) (interface{}, error) {
+		attempts++
+		return nil, &textproto.Error{Code: 430, Msg: "No such article"}
+	})
+	if tperr, ok := err.(*textproto.Error); !ok || tperr.Code != 430 {
+		t.Fatalf("expected 430, got: %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected single attempt, got %d", attempts)
+	}
+	if !b.mc.Missing("test", "<a@b>") {
+		t.Error("missing article not cached")
+	}
+}
+
+func TestTryKeepsPool(t *testing.T) {
+	b, be := newTestBackend(0)
+	pool := b.pp.pools[be.Name]
+
+	// settings of a request started before the pool was rebuilt
+	stale := be
+	stale.Host = "old"
+	a, err := b.try(stale, "body", "<a@b>", func(c *nntpclient.Client) (interface{}, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.pool.Return(a.po)
+	if b.pp.pools[be.Name] != pool {
+		t.Error("pool rebuilt by request")
+	}
+
+	removed := Backend{Name: "removed"}
+	if _, err := b.try(removed, "body", "<a@b>", func(c *nntpclient.Client) (interface{}, error) {
+		return nil, nil
+	}); err != errPoolNotFound {
+		t.Errorf("expected missing pool error, got: %v", err)
+	}
+	if _, ok := b.pp.pools[removed.Name]; ok {
+		t.Error("pool of removed backend created by request")
+	}
+}
+
+func TestTryObserve(t *testing.T) {
+	b, be := newTestBackend(0)
+
+	_, _ = b.try(be, "body", "<a@b>", func(c *nntpclient.Client) (interface{}, error) {
+		return nil, io.ErrUnexpectedEOF
+	})
+
+	if score := b.rt.stats.Score(be.Name); score >= (backendStat{latency: statsLatency}).score() {
+		t.Errorf("failure not reflected in score %v", score)
+	}
+}
+
+// hedgeBackends sets up backends whose requests take given delays,
+// request results are backend names.
+type hedgeBackends struct {
+	sync.Mutex
+	owners map[*nntpclient.Client]string
+	delays map[string]time.Duration
+}
+
+func newHedgeBackend(delays map[string]time.Duration, names ...string) (*NNTPBackend, []Backend, *hedgeBackends) {
+	b, _ := newTestBackend(0)
+	hb := &hedgeBackends{owners: make(map[*nntpclient.Client]string), delays: delays}
+
+	var backends []Backend
+	for _, name := range names {
+		name := name
+		backends = append(backends, Backend{Name: name})
+
+		pool := newTestPool(2, 0, 0)
+		pool.factory = func() (*PooledObject, error) {
+			po, err := pipeObject()
+			if err == nil {
+				hb.Lock()
+				hb.owners[po.object] = name
+				hb.Unlock()
+			}
+			return po, err
+		}
+		b.pp.pools[name] = pool
+	}
+
+	b.hedgeDelay = 20 * time.Millisecond
+	b.hedgeMax = 2
+
+	return b, backends, hb
+}
+
+func (hb *hedgeBackends) request(c *nntpclient.Client) (interface{}, error) {
+	hb.Lock()
+	name := hb.owners[c]
+	hb.Unlock()
+
+	delay, ok := hb.delays[name]
+	if !ok {
+		return nil, &textproto.Error{Code: 430, Msg: "No such article"}
+	}
+	time.Sleep(delay)
+	return name, nil
+}
+
+func TestHedge(t *testing.T) {
+	b, backends, hb := newHedgeBackend(map[string]time.Duration{
+		"slow": time.Second,
+		"fast": 0,
+	}, "slow", "fast")
+
+	start := time.Now()
+	notFound := 0
+	a := b.hedge("body", "<a@b>", backends, hb.request, false, &notFound)
+	if a == nil || a.result != "fast" {
+		t.Fatalf("expected fast backend to win, got %+v", a)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("hedge took %v", elapsed)
+	}
+	a.pool.Return(a.po)
+
+	// loser is dropped once done, as its body wasn't read
+	slow := b.pp.pools["slow"]
+	for i := 0; ; i++ {
+		slow.Lock()
+		active, idle := len(slow.active), len(slow.idle)
+		slow.Unlock()
+		if active == 0 {
+			if idle != 0 {
+				t.Errorf("incomplete connection kept idle")
+			}
+			break
+		}
+		if i == 300 {
+			t.Fatal("loser connection not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHedgeFailover(t *testing.T) {
+	b, backends, hb := newHedgeBackend(map[string]time.Duration{
+		"last": 0,
+	}, "missing1", "missing2", "last")
+
+	notFound := 0
+	a := b.hedge("body", "<a@b>", backends, hb.request, true, &notFound)
+	if a == nil || a.result != "last" {
+		t.Fatalf("expected last backend to answer, got %+v", a)
+	}
+	a.pool.Return(a.po)
+
+	if notFound != 2 {
+		t.Errorf("expected 2 backends without article, got %d", notFound)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	b := &NNTPBackend{
+		ur: &UserRepository{users: map[string]User{
+			"unlimited": {Name: "unlimited", PeriodBytes: 5000},
+			"period":    {Name: "period", Quota: 1000, QuotaPeriod: 30, PeriodBytes: 900},
+			// no period, quota is a total allowance
+			"total": {Name: "total", Quota: 1000, PeriodBytes: 1000},
+		}},
+		ua: NewAccounting(nil, nil),
+	}
+
+	if !b.CheckQuota("unlimited") {
+		t.Error("unlimited user denied")
+	}
+	if b.CheckQuota("total") {
+		t.Error("used up total allowance not enforced")
+	}
+
+	b.ua.AddUser("period", 50)
+	if !b.CheckQuota("period") {
+		t.Error("user denied under quota")
+	}
+
+	// traffic not flushed yet counts
+	b.ua.AddUser("period", 50)
+	if b.CheckQuota("period") {
+		t.Error("pending traffic not counted against quota")
+	}
+}
+
+// newStreamBackend makes backend streaming bodies from fake backends
+// answering BODY with responses, in order of priority.
+func newStreamBackend(responses ...string) *NNTPBackend {
+	b, _ := newTestBackend(0)
+	b.rt.rr = &RuleRepository{}
+	b.br = &BackendRepository{}
+	b.ua = NewAccounting(nil, b.br)
+
+	for i, response := range responses {
+		name := fmt.Sprintf("b%d", i)
+		b.br.backends = append(b.br.backends, Backend{Name: name})
+
+		pool := newTestPool(2, 0, 0)
+		pool.factory = bodyObject(response)
+		b.pp.pools[name] = pool
+	}
+
+	return b
+}
+
+func streamBody(b *NNTPBackend) (io.ReadCloser, error) {
+	_, body, err := b.stream("body", "<a@b>", func(c *nntpclient.Client) (*nntp.Article, error) {
+		return c.Body("<a@b>")
+	})
+	return body, err
+}
+
+// poolState returns number of connections idle and active in pool of backend.
+func poolState(b *NNTPBackend, name string) (int, int) {
+	pool := b.pp.pools[name]
+	pool.Lock()
+	defer pool.Unlock()
+	return len(pool.idle), len(pool.active)
+}
+
+func TestStreamBody(t *testing.T) {
+	b := newStreamBackend("222 0 <a@b>\r\nfirst\r\nsecond\r\n.\r\n")
+
+	body, err := streamBody(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil || string(data) != "first\nsecond\n" {
+		t.Fatalf("unexpected body %q: %v", data, err)
+	}
+	body.Close()
+
+	if idle, active := poolState(b, "b0"); idle != 1 || active != 0 {
+		t.Errorf("expected connection back in pool, %d idle, %d active", idle, active)
+	}
+}
+
+func TestStreamBodyPartlyRead(t *testing.T) {
+	b := newStreamBackend("222 0 <a@b>\r\nfirst\r\nsecond\r\n.\r\n")
+
+	body, err := streamBody(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := body.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+
+	// rest of the response is still on the way, connection is unusable
+	if idle, active := poolState(b, "b0"); idle != 0 || active != 0 {
+		t.Errorf("expected connection dropped, %d idle, %d active", idle, active)
+	}
+}
+
+func TestStreamFailover(t *testing.T) {
+	b := newStreamBackend("222 0 <a@b>\r\n", "222 0 <a@b>\r\nbody\r\n.\r\n")
+
+	// first backend hangs up before the first byte of body
+	body, err := streamBody(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil || string(data) != "body\n" {
+		t.Fatalf("unexpected body %q: %v", data, err)
+	}
+	body.Close()
+
+	if idle, active := poolState(b, "b0"); idle != 0 || active != 0 {
+		t.Errorf("expected broken connection dropped, %d idle, %d active", idle, active)
+	}
+}
+
+func TestStreamCut(t *testing.T) {
+	b := newStreamBackend("222 0 <a@b>\r\nfirst\r\n", "222 0 <a@b>\r\nbody\r\n.\r\n")
+
+	// once body started coming there is no failover
+	body, err := streamBody(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(body); err == nil {
+		t.Fatal("expected cut body to fail")
+	}
+	body.Close()
+
+	if idle, active := poolState(b, "b0"); idle != 0 || active != 0 {
+		t.Errorf("expected broken connection dropped, %d idle, %d active", idle, active)
+	}
+	if idle, active := poolState(b, "b1"); idle != 0 || active != 0 {
+		t.Errorf("expected no failover, %d idle, %d active", idle, active)
+	}
+}
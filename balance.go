@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"math/rand"
+	"nntplexer/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// BalanceOff keeps backends of the same priority in database order.
+	BalanceOff = "off"
+	// BalanceBest puts the best scoring backend of a priority first.
+	BalanceBest = "best"
+	// BalanceRandom orders backends of a priority randomly, weighted by
+	// score, so that load is spread while degraded backends get less.
+	BalanceRandom = "random"
+)
+
+const (
+	OutcomeOk = iota
+	OutcomeMissing
+	OutcomeFailed
+)
+
+const (
+	// statsAlpha is the weight of a new observation in rolling averages
+	statsAlpha = 0.1
+	// statsLatency is latency assumed for backends without observations
+	statsLatency = 0.1
+	// statsSamples is the number of recent latencies kept for percentiles,
+	// statsMinSamples the number needed before percentiles are trusted
+	statsSamples    = 64
+	statsMinSamples = 16
+)
+
+// BackendStats keeps rolling latency, 430 rate and error rate of backends.
+//
+// Without new observations the averages fade back to neutral within
+// window, so a backend which went bad is tried again after a while.
+type BackendStats struct {
+	sync.Mutex
+	window time.Duration
+	stats  map[string]*backendStat
+}
+
+type backendStat struct {
+	latency float64 // seconds till response
+	missing float64 // ratio of 430 responses
+	failed  float64 // ratio of errors
+	updated time.Time
+	// recent latencies of successful requests, a ring buffer
+	samples [statsSamples]time.Duration
+	count   int
+}
+
+func NewBackendStats(window time.Duration) *BackendStats {
+	return &BackendStats{
+		window: window,
+		stats:  make(map[string]*backendStat),
+	}
+}
+
+// Observe records outcome of a request, latency is ignored for failures.
+func (bs *BackendStats) Observe(backend string, outcome int, latency time.Duration) {
+	bs.Lock()
+	defer bs.Unlock()
+
+	now := time.Now()
+	stat := bs.current(backend, now)
+
+	missing, failed := 0.0, 0.0
+	switch outcome {
+	case OutcomeMissing:
+		missing = 1
+	case OutcomeFailed:
+		failed = 1
+	}
+
+	if outcome != OutcomeFailed {
+		stat.latency += statsAlpha * (latency.Seconds() - stat.latency)
+		stat.missing += statsAlpha * (missing - stat.missing)
+	}
+	if outcome == OutcomeOk {
+		stat.samples[stat.count%statsSamples] = latency
+		stat.count++
+	}
+	stat.failed += statsAlpha * (failed - stat.failed)
+	stat.updated = now
+
+	bs.stats[backend] = &stat
+
+	metrics.BackendScore.With(prometheus.Labels{"backend": backend}).Set(stat.score())
+}
+
+// Score rates backend, the higher the better.
+func (bs *BackendStats) Score(backend string) float64 {
+	bs.Lock()
+	defer bs.Unlock()
+
+	stat := bs.current(backend, time.Now())
+	return stat.score()
+}
+
+// Percentile returns p-th percentile of backend's recent latencies,
+// false when there are too few of them.
+func (bs *BackendStats) Percentile(backend string, p float64) (time.Duration, bool) {
+	bs.Lock()
+	stat, ok := bs.stats[backend]
+	if !ok || stat.count < statsMinSamples {
+		bs.Unlock()
+		return 0, false
+	}
+
+	n := stat.count
+	if n > statsSamples {
+		n = statsSamples
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, stat.samples[:n])
+	bs.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	i := int(math.Ceil(p/100*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return samples[i], true
+}
+
+// current returns stats of backend faded towards neutral
+// for the time since they were updated.
+func (bs *BackendStats) current(backend string, now time.Time) backendStat {
+	stat, ok := bs.stats[backend]
+	if !ok {
+		return backendStat{latency: statsLatency}
+	}
+
+	s := *stat
+	if bs.window > 0 {
+		f := math.Exp(-float64(now.Sub(s.updated)) / float64(bs.window))
+		s.latency = statsLatency + (s.latency-statsLatency)*f
+		s.missing *= f
+		s.failed *= f
+	}
+
+	return s
+}
+
+// score is the rate of found articles per second of waiting.
+func (s backendStat) score() float64 {
+	return (1 - s.failed) * (1 - s.missing) / math.Max(s.latency, 0.001)
+}
+
+// balance reorders backends of the same priority, backends are
+// expected to be sorted by priority. Passed slice isn't modified.
+func (rt *Router) balance(backends []Backend) []Backend {
+	if rt.stats == nil || rt.mode == "" || rt.mode == BalanceOff {
+		return backends
+	}
+
+	ordered := make([]Backend, len(backends))
+	copy(ordered, backends)
+
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+
+		if end-start > 1 {
+			tier := ordered[start:end]
+			scores := make(map[string]float64, len(tier))
+			for _, be := range tier {
+				scores[be.Name] = rt.stats.Score(be.Name)
+			}
+
+			if rt.mode == BalanceBest {
+				sort.SliceStable(tier, func(i, j int) bool {
+					return scores[tier[i].Name] > scores[tier[j].Name]
+				})
+			} else {
+				shuffle(tier, scores)
+			}
+		}
+
+		start = end
+	}
+
+	return ordered
+}
+
+// shuffle orders backends randomly, a backend gets ahead of the
+// remaining ones with probability proportional to its score.
+func shuffle(backends []Backend, scores map[string]float64) {
+	for i := range backends[:len(backends)-1] {
+		total := 0.0
+		for _, be := range backends[i:] {
+			total += scores[be.Name]
+		}
+		if total <= 0 {
+			return
+		}
+
+		pick := len(backends) - 1
+		r := rand.Float64() * total
+		for j, be := range backends[i:] {
+			if r < scores[be.Name] {
+				pick = i + j
+				break
+			}
+			r -= scores[be.Name]
+		}
+
+		backends[i], backends[pick] = backends[pick], backends[i]
+	}
+}
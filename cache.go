@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/textproto"
+)
+
+// ArticleCache stores fetched articles by message-id.
+//
+// Entry holds either a whole article or just its body, depending on
+// the command it was fetched with. Body only entries can't serve ARTICLE.
+type ArticleCache interface {
+	// Get opens cached article for cmd.
+	Get(cmd string, messageId string) (textproto.MIMEHeader, io.ReadCloser, bool)
+	// Put starts storing article, headers are nil for body only entries.
+	Put(messageId string, headers textproto.MIMEHeader) (CacheWriter, error)
+}
+
+// CacheWriter receives article body. Entry becomes visible on Close,
+// while Abort discards everything written so far.
+type CacheWriter interface {
+	io.WriteCloser
+	Abort()
+}
+
+// TieredCache looks article up in tiers in order, e.g. local disks first,
+// remote storage then. Articles found in a later tier are copied to the
+// earlier ones while read, new articles are stored in all tiers.
+type TieredCache struct {
+	tiers []ArticleCache
+}
+
+func NewTieredCache(tiers ...ArticleCache) *TieredCache {
+	return &TieredCache{tiers: tiers}
+}
+
+func (tc *TieredCache) Get(cmd string, messageId string) (textproto.MIMEHeader, io.ReadCloser, bool) {
+	for i, tier := range tc.tiers {
+		headers, body, ok := tier.Get(cmd, messageId)
+		if !ok {
+			continue
+		}
+
+		if i > 0 {
+			// body only entries are stored without headers
+			var cacheHeaders textproto.MIMEHeader
+			if cmd == "article" {
+				cacheHeaders = headers
+			}
+			body = newCacheReader(NewTieredCache(tc.tiers[:i]...), messageId, cacheHeaders, body)
+		}
+
+		return headers, body, true
+	}
+
+	return nil, nil, false
+}
+
+func (tc *TieredCache) Put(messageId string, headers textproto.MIMEHeader) (CacheWriter, error) {
+	var writers multiWriter
+
+	for _, tier := range tc.tiers {
+		w, err := tier.Put(messageId, headers)
+		if err != nil {
+			log.Printf("[cache] put %s: %v\n", messageId, err)
+			continue
+		}
+		writers = append(writers, w)
+	}
+
+	if len(writers) == 0 {
+		return nil, errors.New("no cache tier available")
+	}
+
+	return &writers, nil
+}
+
+// multiWriter stores article in several caches, a failing one is
+// dropped without affecting the others.
+type multiWriter []CacheWriter
+
+func (mw *multiWriter) Write(p []byte) (int, error) {
+	writers := (*mw)[:0]
+	for _, w := range *mw {
+		if _, err := w.Write(p); err != nil {
+			log.Printf("[cache] write: %v\n", err)
+			w.Abort()
+			continue
+		}
+		writers = append(writers, w)
+	}
+	*mw = writers
+
+	if len(writers) == 0 {
+		return 0, errors.New("all cache writes failed")
+	}
+	return len(p), nil
+}
+
+func (mw *multiWriter) Close() error {
+	var err error
+	for _, w := range *mw {
+		if cerr := w.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (mw *multiWriter) Abort() {
+	for _, w := range *mw {
+		w.Abort()
+	}
+}
+
+// cacheReader passes article body through while storing it in cache.
+// Only bodies read till the end are committed.
+type cacheReader struct {
+	io.ReadCloser
+	w      CacheWriter
+	eof    bool
+	failed bool
+}
+
+func newCacheReader(cache ArticleCache, messageId string, headers textproto.MIMEHeader, body io.ReadCloser) io.ReadCloser {
+	w, err := cache.Put(messageId, headers)
+	if err != nil {
+		log.Printf("[cache] put %s: %v\n", messageId, err)
+		return body
+	}
+
+	return &cacheReader{ReadCloser: body, w: w}
+}
+
+func (r *cacheReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+
+	if n > 0 && !r.failed {
+		if _, werr := r.w.Write(p[:n]); werr != nil {
+			// cache failures must not break the client, just stop caching
+			log.Printf("[cache] write: %v\n", werr)
+			r.failed = true
+			r.w.Abort()
+		}
+	}
+
+	if err == io.EOF {
+		r.eof = true
+	}
+
+	return n, err
+}
+
+func (r *cacheReader) Close() error {
+	err := r.ReadCloser.Close()
+
+	if r.failed {
+		return err
+	}
+
+	if r.eof {
+		if cerr := r.w.Close(); cerr != nil {
+			log.Printf("[cache] commit: %v\n", cerr)
+		}
+	} else {
+		r.w.Abort()
+	}
+	r.failed = true
+
+	return err
+}
+
+// writeHeaders serializes headers the way textproto reads them back.
+func writeHeaders(w io.Writer, headers textproto.MIMEHeader) error {
+	for key, values := range headers {
+		for _, value := range values {
+			if _, err := io.WriteString(w, key+": "+value+"\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
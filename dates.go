@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+// datesMaxPending limits dates queued between flushes.
+const datesMaxPending = 100000
+
+// ArticleDates keeps post dates of recently requested articles in memory
+// in front of ArticleRepository, so that only articles not seen lately
+// cost a database lookup. Lookups which found nothing are remembered as
+// well. New dates are queued and written in batches by Flush, run along
+// with traffic accounting flushes.
+type ArticleDates struct {
+	sync.Mutex
+	ar      *ArticleRepository
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	// pending dates are not written yet
+	pending map[string]time.Time
+}
+
+type dateEntry struct {
+	messageId string
+	date      time.Time // zero when unknown
+}
+
+func NewArticleDates(ar *ArticleRepository, size int) *ArticleDates {
+	return &ArticleDates{
+		ar:      ar,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]time.Time),
+	}
+}
+
+// Date returns known post date of an article.
+func (ad *ArticleDates) Date(messageId string) (time.Time, bool) {
+	ad.Lock()
+	if element, ok := ad.entries[messageId]; ok {
+		ad.lru.MoveToFront(element)
+		date := element.Value.(*dateEntry).date
+		ad.Unlock()
+		return date, !date.IsZero()
+	}
+	ad.Unlock()
+
+	date, ok := ad.ar.Date(messageId)
+
+	ad.Lock()
+	defer ad.Unlock()
+	// date may have been added meanwhile
+	if _, found := ad.entries[messageId]; !found {
+		ad.put(messageId, date)
+	}
+
+	return date, ok
+}
+
+// Add queues post date of an article for writing, unless it's known already.
+func (ad *ArticleDates) Add(messageId string, date time.Time) {
+	ad.Lock()
+	defer ad.Unlock()
+
+	if element, ok := ad.entries[messageId]; ok {
+		ad.lru.MoveToFront(element)
+		entry := element.Value.(*dateEntry)
+		if entry.date.Equal(date) {
+			return
+		}
+		entry.date = date
+	} else {
+		ad.put(messageId, date)
+	}
+
+	if len(ad.pending) >= datesMaxPending {
+		log.Printf("[articles] write queue full, date of %s dropped\n", messageId)
+		return
+	}
+	ad.pending[messageId] = date
+}
+
+func (ad *ArticleDates) put(messageId string, date time.Time) {
+	ad.entries[messageId] = ad.lru.PushFront(&dateEntry{messageId: messageId, date: date})
+
+	for ad.lru.Len() > ad.size {
+		element := ad.lru.Back()
+		ad.lru.Remove(element)
+		delete(ad.entries, element.Value.(*dateEntry).messageId)
+	}
+}
+
+// Flush writes queued dates to database.
+func (ad *ArticleDates) Flush() {
+	ad.Lock()
+	pending := ad.pending
+	ad.pending = make(map[string]time.Time)
+	ad.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := ad.ar.CreateBatch(pending); err != nil {
+		log.Printf("[articles] flush: %v\n", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArticleDates(t *testing.T) {
+	// no repository, any database access would panic
+	ad := NewArticleDates(nil, 2)
+	date := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	ad.Add("<a@b>", date)
+	if known, ok := ad.Date("<a@b>"); !ok || !known.Equal(date) {
+		t.Errorf("expected cached date, got %v", known)
+	}
+
+	// known date isn't written again
+	ad.Add("<a@b>", date)
+	if len(ad.pending) != 1 {
+		t.Errorf("expected single pending date, got %d", len(ad.pending))
+	}
+
+	ad.pending = make(map[string]time.Time)
+	ad.Add("<a@b>", date)
+	if len(ad.pending) != 0 {
+		t.Error("flushed date queued again")
+	}
+
+	// least recently used date is evicted
+	ad.Add("<c@d>", date)
+	ad.Date("<a@b>")
+	ad.Add("<e@f>", date)
+	if _, ok := ad.entries["<c@d>"]; ok || len(ad.entries) != 2 {
+		t.Errorf("expected <c@d> evicted, got %d entries", len(ad.entries))
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log"
+	"net/textproto"
+	"nntplexer/metrics"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskArticleSuffix = ".a"
+	diskBodySuffix    = ".b"
+	diskTempSuffix    = ".tmp"
+
+	// diskMarker is created in cache directory on start. Marker missing
+	// later means the disk is gone, leaving just an empty mount point.
+	diskMarker = ".nntplexer-cache"
+)
+
+// DiskCache keeps articles as files in a local directory.
+//
+// Files are named by message-id hash and spread over 256 subdirectories.
+// Each file holds article headers followed by an empty line and the body,
+// body only entries have no headers. Index is kept in memory and rebuilt
+// from directory contents on start. Entries older than ttl are dropped,
+// least recently used ones are evicted once maxBytes is exceeded.
+//
+// Disk failures are not fatal: once the disk is found broken by Check,
+// its entries are forgotten and every lookup is a miss until it's back.
+type DiskCache struct {
+	sync.Mutex
+	dir      string
+	up       bool
+	maxBytes int64
+	ttl      time.Duration
+	bytes    int64
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type diskEntry struct {
+	key     string
+	article bool
+	size    int64
+	stored  time.Time
+}
+
+func NewDiskCache(dir string, maxBytes int64, ttl time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	marker, err := os.OpenFile(filepath.Join(dir, diskMarker), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_ = marker.Close()
+
+	dc := &DiskCache{
+		dir:      dir,
+		up:       true,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+
+	if err := dc.load(); err != nil {
+		return nil, err
+	}
+
+	return dc, nil
+}
+
+// Get opens cached entry, misses aren't counted in metrics,
+// as the same article is looked up on every disk.
+func (dc *DiskCache) Get(cmd string, messageId string) (textproto.MIMEHeader, io.ReadCloser, bool) {
+	if cmd != "article" && cmd != "body" {
+		return nil, nil, false
+	}
+
+	key := diskKey(messageId)
+
+	dc.Lock()
+	element, ok := dc.entries[key]
+	if ok {
+		entry := element.Value.(*diskEntry)
+		switch {
+		case dc.expired(entry):
+			dc.remove(element)
+			ok = false
+		case cmd == "article" && !entry.article:
+			ok = false
+		default:
+			dc.lru.MoveToFront(element)
+		}
+	}
+	dc.Unlock()
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	entry := element.Value.(*diskEntry)
+
+	f, err := os.Open(dc.path(entry.key, entry.article))
+	if err != nil {
+		dc.error("open", err)
+		dc.drop(element)
+		return nil, nil, false
+	}
+
+	r := bufio.NewReader(f)
+	headers, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		dc.error("read", err)
+		_ = f.Close()
+		dc.drop(element)
+		return nil, nil, false
+	}
+
+	metrics.CacheRequests.With(prometheus.Labels{"result": "hit"}).Inc()
+	metrics.CacheBytesSaved.Add(float64(entry.size))
+
+	return headers, &fileReader{Reader: r, file: f}, true
+}
+
+func (dc *DiskCache) Put(messageId string, headers textproto.MIMEHeader) (CacheWriter, error) {
+	if !dc.Up() {
+		return nil, fmt.Errorf("%s is down", dc.dir)
+	}
+
+	key := diskKey(messageId)
+	article := headers != nil
+
+	path := dc.path(key, article)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		dc.error("mkdir", err)
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+diskTempSuffix+"*")
+	if err != nil {
+		dc.error("create", err)
+		return nil, err
+	}
+
+	w := &diskWriter{
+		Writer:  bufio.NewWriter(f),
+		dc:      dc,
+		file:    f,
+		key:     key,
+		article: article,
+	}
+
+	if err := writeHeaders(w, headers); err != nil {
+		w.Abort()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Up tells whether disk is usable.
+func (dc *DiskCache) Up() bool {
+	dc.Lock()
+	defer dc.Unlock()
+	return dc.up
+}
+
+// Check verifies the disk is still there and writable. Broken disk's
+// entries are forgotten, once disk is back its index is loaded again.
+func (dc *DiskCache) Check() {
+	err := dc.probe()
+
+	dc.Lock()
+	wasUp := dc.up
+	dc.up = err == nil
+
+	switch {
+	case err != nil && wasUp:
+		log.Printf("[cache] %s is down: %v\n", dc.dir, err)
+		metrics.CacheDiskErrors.With(prometheus.Labels{"disk": dc.dir, "op": "check"}).Inc()
+		for dc.lru.Len() > 0 {
+			dc.forget(dc.lru.Back())
+		}
+	case err == nil && !wasUp:
+		log.Printf("[cache] %s is up again\n", dc.dir)
+	}
+	dc.Unlock()
+
+	if err == nil && !wasUp {
+		if err := dc.load(); err != nil {
+			dc.error("load", err)
+		}
+	}
+
+	if dc.up {
+		metrics.CacheDiskUp.With(prometheus.Labels{"disk": dc.dir}).Set(1)
+	} else {
+		metrics.CacheDiskUp.With(prometheus.Labels{"disk": dc.dir}).Set(0)
+	}
+}
+
+// probe checks marker presence and writes a probe file.
+func (dc *DiskCache) probe() error {
+	if _, err := os.Stat(filepath.Join(dc.dir, diskMarker)); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dc.dir, "probe"+diskTempSuffix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("probe"))
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+
+	return err
+}
+
+func (dc *DiskCache) error(op string, err error) {
+	log.Printf("[cache] %s %s: %v\n", dc.dir, op, err)
+	metrics.CacheDiskErrors.With(prometheus.Labels{"disk": dc.dir, "op": op}).Inc()
+}
+
+// Cleanup drops entries older than ttl.
+func (dc *DiskCache) Cleanup() {
+	if dc.ttl == 0 {
+		return
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	for element := dc.lru.Back(); element != nil; {
+		prev := element.Prev()
+		if dc.expired(element.Value.(*diskEntry)) {
+			dc.remove(element)
+		}
+		element = prev
+	}
+}
+
+// load rebuilds index from files found in cache directory.
+func (dc *DiskCache) load() error {
+	var entries []*diskEntry
+
+	err := filepath.Walk(dc.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		name := info.Name()
+		switch {
+		case name == diskMarker:
+		case strings.Contains(name, diskTempSuffix):
+			// leftover of an interrupted write
+			_ = os.Remove(path)
+		case strings.HasSuffix(name, diskArticleSuffix), strings.HasSuffix(name, diskBodySuffix):
+			entries = append(entries, &diskEntry{
+				key:     name[:len(name)-2],
+				article: strings.HasSuffix(name, diskArticleSuffix),
+				size:    info.Size(),
+				stored:  info.ModTime(),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// oldest entries go to the back of lru list
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].stored.Before(entries[j].stored)
+	})
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	for _, entry := range entries {
+		dc.add(entry)
+	}
+
+	log.Printf("[cache] %s: %d articles, %d bytes\n", dc.dir, dc.lru.Len(), dc.bytes)
+
+	return nil
+}
+
+// add puts entry in front of lru list, replacing an existing one for
+// the same key and evicting old entries if cache is full.
+func (dc *DiskCache) add(entry *diskEntry) {
+	if element, ok := dc.entries[entry.key]; ok {
+		old := element.Value.(*diskEntry)
+		if old.article != entry.article {
+			dc.remove(element)
+		} else {
+			// file was already replaced by rename
+			dc.forget(element)
+		}
+	}
+
+	dc.entries[entry.key] = dc.lru.PushFront(entry)
+	dc.bytes += entry.size
+
+	for dc.maxBytes > 0 && dc.bytes > dc.maxBytes && dc.lru.Len() > 1 {
+		dc.remove(dc.lru.Back())
+	}
+
+	metrics.CacheBytes.With(prometheus.Labels{"disk": dc.dir}).Set(float64(dc.bytes))
+}
+
+// drop removes entry unless it was already replaced.
+func (dc *DiskCache) drop(element *list.Element) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	entry := element.Value.(*diskEntry)
+	if dc.entries[entry.key] == element {
+		dc.remove(element)
+	}
+}
+
+// remove deletes entry file and forgets it.
+func (dc *DiskCache) remove(element *list.Element) {
+	entry := element.Value.(*diskEntry)
+	if err := os.Remove(dc.path(entry.key, entry.article)); err != nil && !os.IsNotExist(err) {
+		dc.error("remove", err)
+	}
+	dc.forget(element)
+}
+
+func (dc *DiskCache) forget(element *list.Element) {
+	entry := element.Value.(*diskEntry)
+	dc.lru.Remove(element)
+	delete(dc.entries, entry.key)
+	dc.bytes -= entry.size
+
+	metrics.CacheBytes.With(prometheus.Labels{"disk": dc.dir}).Set(float64(dc.bytes))
+}
+
+func (dc *DiskCache) expired(entry *diskEntry) bool {
+	return dc.ttl > 0 && time.Since(entry.stored) > dc.ttl
+}
+
+func (dc *DiskCache) path(key string, article bool) string {
+	suffix := diskBodySuffix
+	if article {
+		suffix = diskArticleSuffix
+	}
+	return filepath.Join(dc.dir, key[:2], key+suffix)
+}
+
+func diskKey(messageId string) string {
+	h := sha1.Sum([]byte(messageId))
+	return hex.EncodeToString(h[:])
+}
+
+// diskWriter writes entry into a temporary file,
+// which is renamed to its final name on Close.
+type diskWriter struct {
+	*bufio.Writer
+	dc      *DiskCache
+	file    *os.File
+	key     string
+	article bool
+}
+
+func (w *diskWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		w.dc.error("write", err)
+		w.Abort()
+		return err
+	}
+
+	info, err := w.file.Stat()
+	if err != nil {
+		w.dc.error("stat", err)
+		w.Abort()
+		return err
+	}
+
+	if err := w.file.Close(); err != nil {
+		w.dc.error("close", err)
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+
+	if err := os.Rename(w.file.Name(), w.dc.path(w.key, w.article)); err != nil {
+		w.dc.error("rename", err)
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+
+	w.dc.Lock()
+	defer w.dc.Unlock()
+
+	// disk went down while entry was written
+	if !w.dc.up {
+		return fmt.Errorf("%s is down", w.dc.dir)
+	}
+
+	w.dc.add(&diskEntry{
+		key:     w.key,
+		article: w.article,
+		size:    info.Size(),
+		stored:  time.Now(),
+	})
+
+	return nil
+}
+
+func (w *diskWriter) Abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+// fileReader reads cached entry body and closes its file.
+type fileReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *fileReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func putArticle(t *testing.T, cache ArticleCache, messageId string, headers textproto.MIMEHeader, body string) {
+	t.Helper()
+
+	w, err := cache.Put(messageId, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getArticle(t *testing.T, cache ArticleCache, cmd string, messageId string) (textproto.MIMEHeader, string, bool) {
+	t.Helper()
+
+	headers, r, ok := cache.Get(cmd, messageId)
+	if !ok {
+		return nil, "", false
+	}
+	defer r.Close()
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return headers, string(body), true
+}
+
+func TestDiskCache(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putArticle(t, dc, "<a@x>", textproto.MIMEHeader{"Subject": {"test"}}, "line 1\r\nline 2\r\n")
+	putArticle(t, dc, "<b@x>", nil, "body only\r\n")
+
+	headers, body, ok := getArticle(t, dc, "article", "<a@x>")
+	if !ok || headers.Get("Subject") != "test" || body != "line 1\r\nline 2\r\n" {
+		t.Fatalf("unexpected article: %v %v %q", ok, headers, body)
+	}
+
+	if _, body, ok := getArticle(t, dc, "body", "<a@x>"); !ok || body != "line 1\r\nline 2\r\n" {
+		t.Fatalf("unexpected body: %v %q", ok, body)
+	}
+
+	if _, _, ok := getArticle(t, dc, "article", "<b@x>"); ok {
+		t.Fatal("body only entry served as article")
+	}
+
+	if _, body, ok := getArticle(t, dc, "body", "<b@x>"); !ok || body != "body only\r\n" {
+		t.Fatalf("unexpected body: %v %q", ok, body)
+	}
+
+	// upgrading body only entry to an article replaces it
+	putArticle(t, dc, "<b@x>", textproto.MIMEHeader{"Subject": {"b"}}, "body only\r\n")
+	if _, _, ok := getArticle(t, dc, "article", "<b@x>"); !ok {
+		t.Fatal("article not found after upgrade")
+	}
+	if dc.lru.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", dc.lru.Len())
+	}
+}
+
+func TestDiskCacheAbort(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := dc.Put("<a@x>", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("partial"))
+	w.Abort()
+
+	if _, _, ok := getArticle(t, dc, "body", "<a@x>"); ok {
+		t.Fatal("aborted entry served")
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+
+	dc, err := NewDiskCache(dir, 30, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putArticle(t, dc, "<a@x>", nil, "0123456789")
+	putArticle(t, dc, "<b@x>", nil, "0123456789")
+
+	// touch <a@x>, so that <b@x> is evicted
+	getArticle(t, dc, "body", "<a@x>")
+	putArticle(t, dc, "<c@x>", nil, "0123456789")
+
+	if _, _, ok := getArticle(t, dc, "body", "<b@x>"); ok {
+		t.Fatal("least recently used entry not evicted")
+	}
+
+	// index is rebuilt from files
+	reloaded, err := NewDiskCache(dir, 30, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"<a@x>", "<c@x>"} {
+		if _, _, ok := getArticle(t, reloaded, "body", id); !ok {
+			t.Fatalf("%s not found after reload", id)
+		}
+	}
+}
+
+func TestDiskCacheTtl(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putArticle(t, dc, "<a@x>", nil, "body")
+	time.Sleep(5 * time.Millisecond)
+	dc.Cleanup()
+
+	if dc.lru.Len() != 0 || dc.bytes != 0 {
+		t.Fatal("expired entry not cleaned up")
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/pires/go-proxyproto v0.5.0
 	github.com/prometheus/client_golang v1.11.0
 	github.com/smartystreets/goconvey v1.6.4 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/ini.v1 v1.62.0
 	gorm.io/driver/mysql v1.1.0
 	gorm.io/gorm v1.21.10
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log"
+	"net/textproto"
+	"nntplexer/metrics"
+	"nntplexer/nntp"
+	"nntplexer/nntp/nntpclient"
+	"strconv"
+)
+
+// Group commands and articles by number go to the primary backend only,
+// article numbers are assigned by each backend on its own, so a number
+// means a different article (if any) anywhere else. Backend connections
+// are pooled and shared between sessions, therefore every request selects
+// session's group again before acting on it.
+
+// primaryBackend returns backend configured as primary,
+// the first backend by priority when none is.
+func (b *NNTPBackend) primaryBackend() (Backend, bool) {
+	backends := b.br.Get()
+	for _, be := range backends {
+		if b.primary == "" || be.Name == b.primary {
+			return be, true
+		}
+	}
+
+	return Backend{}, false
+}
+
+// onPrimary runs request on primary backend within group, empty group
+// leaves group selection to request. Connection is left checked out.
+func (b *NNTPBackend) onPrimary(cmd string, group string, request request) (*attempt, error) {
+	be, ok := b.primaryBackend()
+	if !ok {
+		log.Printf("[backend] Primary backend %q not found\n", b.primary)
+		return nil, &textproto.Error{Code: 403, Msg: "Something went wrong"}
+	}
+
+	a, err := b.try(be, cmd, "", func(c *nntpclient.Client) (interface{}, error) {
+		if group != "" {
+			if _, err := c.Group(group); err != nil {
+				return nil, err
+			}
+		}
+		return request(c)
+	})
+	if err != nil {
+		// 400 would tell the client its own connection is going away
+		if tperr, ok := err.(*textproto.Error); ok && tperr.Code != 400 {
+			return nil, err
+		}
+		return nil, &textproto.Error{Code: 403, Msg: "Something went wrong"}
+	}
+
+	metrics.BackendRequests.With(prometheus.Labels{"backend": a.be.Name, "code": strconv.Itoa(a.po.object.GetCode())}).Inc()
+
+	return a, nil
+}
+
+// onPrimaryComplete is onPrimary for requests reading the whole
+// response, connection goes back to the pool right away.
+func (b *NNTPBackend) onPrimaryComplete(cmd string, group string, request request) (interface{}, error) {
+	a, err := b.onPrimary(cmd, group, request)
+	if err != nil {
+		return nil, err
+	}
+	a.pool.Return(a.po)
+
+	return a.result, nil
+}
+
+func (b *NNTPBackend) Group(name string) (nntp.Group, error) {
+	result, err := b.onPrimaryComplete("group", "", func(c *nntpclient.Client) (interface{}, error) {
+		return c.Group(name)
+	})
+	if err != nil {
+		return nntp.Group{}, err
+	}
+
+	return result.(nntp.Group), nil
+}
+
+func (b *NNTPBackend) ListGroup(name string, rng string) (nntp.Group, []int64, error) {
+	type listing struct {
+		group   nntp.Group
+		numbers []int64
+	}
+
+	result, err := b.onPrimaryComplete("listgroup", "", func(c *nntpclient.Client) (interface{}, error) {
+		group, numbers, err := c.ListGroup(name, rng)
+		return listing{group: group, numbers: numbers}, err
+	})
+	if err != nil {
+		return nntp.Group{}, nil, err
+	}
+
+	l := result.(listing)
+	return l.group, l.numbers, nil
+}
+
+// pointer is an article number and message-id pair.
+type pointer struct {
+	number    int64
+	messageId string
+}
+
+// move sets current article of group to number and moves it with step.
+func (b *NNTPBackend) move(cmd string, group string, number int64, step func(c *nntpclient.Client) (int64, string, error)) (int64, string, error) {
+	result, err := b.onPrimaryComplete(cmd, group, func(c *nntpclient.Client) (interface{}, error) {
+		if err := c.Stat(strconv.FormatInt(number, 10)); err != nil {
+			return nil, err
+		}
+		n, id, err := step(c)
+		return pointer{number: n, messageId: id}, err
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	p := result.(pointer)
+	return p.number, p.messageId, nil
+}
+
+func (b *NNTPBackend) Next(group string, number int64) (int64, string, error) {
+	return b.move("next", group, number, (*nntpclient.Client).Next)
+}
+
+func (b *NNTPBackend) Last(group string, number int64) (int64, string, error) {
+	return b.move("last", group, number, (*nntpclient.Client).Last)
+}
+
+func (b *NNTPBackend) GroupArticle(group string, number int64) (string, textproto.MIMEHeader, io.ReadCloser, error) {
+	return b.numbered("article", group, func(c *nntpclient.Client) (*nntp.Article, error) {
+		return c.Article(strconv.FormatInt(number, 10))
+	})
+}
+
+func (b *NNTPBackend) GroupBody(group string, number int64) (string, io.ReadCloser, error) {
+	messageId, _, body, err := b.numbered("body", group, func(c *nntpclient.Client) (*nntp.Article, error) {
+		return c.Body(strconv.FormatInt(number, 10))
+	})
+	return messageId, body, err
+}
+
+// numbered opens article by number, the body is read from connection
+// checked out of the pool just like in stream.
+func (b *NNTPBackend) numbered(cmd string, group string, open func(c *nntpclient.Client) (*nntp.Article, error)) (string, textproto.MIMEHeader, io.ReadCloser, error) {
+	// requests on a single backend run one at a time, no need to sync
+	var messageId string
+	a, err := b.onPrimary(cmd, group, opening(func(c *nntpclient.Client) (*nntp.Article, error) {
+		article, err := open(c)
+		if err != nil {
+			return nil, err
+		}
+		_, messageId, err = c.ArticlePointer()
+		return article, err
+	}))
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return messageId, a.result.(*nntp.Article).Headers, b.reader(a), nil
+}
+
+func (b *NNTPBackend) GroupHead(group string, number int64) (string, textproto.MIMEHeader, error) {
+	var messageId string
+	result, err := b.onPrimaryComplete("head", group, func(c *nntpclient.Client) (interface{}, error) {
+		headers, err := c.Head(strconv.FormatInt(number, 10))
+		if err != nil {
+			return nil, err
+		}
+		_, messageId, err = c.ArticlePointer()
+		return headers, err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return messageId, result.(textproto.MIMEHeader), nil
+}
+
+func (b *NNTPBackend) GroupStat(group string, number int64) (string, error) {
+	result, err := b.onPrimaryComplete("stat", group, func(c *nntpclient.Client) (interface{}, error) {
+		if err := c.Stat(strconv.FormatInt(number, 10)); err != nil {
+			return nil, err
+		}
+		_, id, err := c.ArticlePointer()
+		return id, err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result.(string), nil
+}
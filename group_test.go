@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"nntplexer/nntp/nntpclient"
+	"strings"
+	"testing"
+)
+
+// groupObject connects a client to a fake backend holding article 7
+// in group misc.test and serving its overview by message-id. The backend
+// forgets selected group after each command like a pooled connection
+// shared between sessions would.
+func groupObject() (*PooledObject, error) {
+	server, conn := net.Pipe()
+
+	go func() {
+		text := textproto.NewConn(server)
+		defer text.Close()
+
+		if err := text.PrintfLine("200 fake server ready"); err != nil {
+			return
+		}
+		group := ""
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+
+			fields := strings.Fields(line)
+			switch {
+			case fields[0] == "GROUP" && fields[1] == "misc.test":
+				group = fields[1]
+				err = text.PrintfLine("211 1 7 7 misc.test")
+			case fields[0] == "GROUP":
+				err = text.PrintfLine("411 No such newsgroup")
+			case fields[0] == "CAPABILITIES":
+				err = text.PrintfLine("101 Capability list:\r\nVERSION 2\r\nOVER MSGID\r\n.")
+			case fields[0] == "OVER" && fields[1] == "<7@test>":
+				err = text.PrintfLine("224 Overview information follows\r\n0\tseven\r\n.")
+			case group == "":
+				err = text.PrintfLine("412 No newsgroup selected")
+			case fields[0] == "ARTICLE" && fields[1] == "7":
+				group = ""
+				err = text.PrintfLine("220 7 <7@test>\r\nSubject: seven\r\n\r\nbody\r\n.")
+			default:
+				group = ""
+				err = text.PrintfLine("423 No article with that number")
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	client, err := nntpclient.NewClient(conn, &nntpclient.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PooledObject{object: client, valid: true}, nil
+}
+
+func newGroupBackend() *NNTPBackend {
+	b, be := newTestBackend(0)
+	b.br = &BackendRepository{backends: []Backend{be}}
+	b.pp.pools[be.Name].factory = groupObject
+	b.ua = NewAccounting(nil, b.br)
+
+	return b
+}
+
+func TestGroupArticle(t *testing.T) {
+	b := newGroupBackend()
+
+	// twice, so that the pooled connection is reused
+	for i := 0; i < 2; i++ {
+		messageId, headers, body, err := b.GroupArticle("misc.test", 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+
+		if err != nil || messageId != "<7@test>" || headers.Get("Subject") != "seven" || string(data) != "body\n" {
+			t.Fatalf("unexpected article %s %v %q: %v", messageId, headers, data, err)
+		}
+	}
+
+	pool := b.pp.pools["test"]
+	if len(pool.idle) != 1 {
+		t.Errorf("expected connection back in pool, got %d idle", len(pool.idle))
+	}
+}
+
+func TestGroupArticleNotFound(t *testing.T) {
+	b := newGroupBackend()
+
+	if _, _, _, err := b.GroupArticle("misc.test", 8); !hasCode(err, 423) {
+		t.Errorf("expected 423, got: %v", err)
+	}
+	if _, err := b.Group("alt.none"); !hasCode(err, 411) {
+		t.Errorf("expected 411, got: %v", err)
+	}
+
+	b.primary = "other"
+	if _, err := b.Group("misc.test"); !hasCode(err, 403) {
+		t.Errorf("expected 403 without primary backend, got: %v", err)
+	}
+}
+
+func hasCode(err error, code int) bool {
+	tperr, ok := err.(*textproto.Error)
+	return ok && tperr.Code == code
+}
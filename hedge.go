@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/textproto"
+	"nntplexer/metrics"
+	"time"
+)
+
+// hedging tells whether hedged requests are enabled.
+func (b *NNTPBackend) hedging() bool {
+	return b.hedgeMax > 1 && (b.hedgeDelay > 0 || b.hedgePercentile > 0)
+}
+
+// hedgeAfter returns how long to wait for backend before asking the next
+// one too, false means backend is waited for as long as it takes.
+func (b *NNTPBackend) hedgeAfter(be Backend) (time.Duration, bool) {
+	if b.hedgePercentile > 0 && b.rt.stats != nil {
+		if delay, ok := b.rt.stats.Percentile(be.Name, b.hedgePercentile); ok {
+			if delay < b.hedgeDelay {
+				// fixed delay is the floor, percentiles of a fast
+				// backend would hedge nearly every request otherwise
+				delay = b.hedgeDelay
+			}
+			return delay, true
+		}
+	}
+
+	return b.hedgeDelay, b.hedgeDelay > 0
+}
+
+// hedged is an outcome of a request run on one of hedged backends.
+type hedged struct {
+	a   *attempt
+	err error
+}
+
+// hedge runs request on candidates in order like acquire does, but once
+// a backend is slow to answer, the next one is asked as well without
+// waiting. The first success wins, connections of the slower ones are
+// returned to their pools once they are done: intact if request read the
+// whole response, dropped otherwise as they are in the middle of a body.
+func (b *NNTPBackend) hedge(cmd string, messageId string, candidates []Backend, request request, complete bool, notFound *int) *attempt {
+	// buffered, so that late requests never block on a finished hedge
+	results := make(chan hedged, len(candidates))
+
+	next, running, hedges := 0, 0, 0
+	launch := func(hedge bool) {
+		be := candidates[next]
+		next++
+		running++
+
+		if hedge {
+			hedges++
+			metrics.BackendHedges.With(prometheus.Labels{"backend": be.Name, "result": "launched"}).Inc()
+		}
+
+		go func() {
+			a, err := b.try(be, cmd, messageId, request)
+			results <- hedged{a: a, err: err}
+		}()
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	// arm (re)starts waiting for the latest launched backend
+	arm := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if delay, ok := b.hedgeAfter(candidates[next-1]); ok && next < len(candidates) {
+			timer.Reset(delay)
+		}
+	}
+
+	launch(false)
+	arm()
+
+	// overdue is set when hedge was due but too many requests were running
+	overdue := false
+
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+
+			if r.err == nil {
+				if hedges > 0 {
+					metrics.BackendHedges.With(prometheus.Labels{"backend": r.a.be.Name, "result": "won"}).Inc()
+				}
+				go b.discard(results, running, complete)
+				return r.a
+			}
+
+			if tperr, ok := r.err.(*textproto.Error); ok && tperr.Code == 430 {
+				*notFound++
+			}
+
+			// fail over right away when nothing is left running
+			// or the running ones are already late
+			if next < len(candidates) && (running == 0 || overdue) {
+				launch(running > 0)
+				overdue = false
+				arm()
+			}
+		case <-timer.C:
+			if running < b.hedgeMax {
+				launch(true)
+				arm()
+			} else {
+				overdue = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// discard waits for requests which lost a hedge and releases their connections.
+func (b *NNTPBackend) discard(results chan hedged, running int, complete bool) {
+	for ; running > 0; running-- {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+
+		if !complete {
+			r.a.po.Invalidate()
+		}
+		r.a.pool.Return(r.a.po)
+	}
+}
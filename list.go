@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"nntplexer/metrics"
+	"nntplexer/nntp/nntpclient"
+	"sync"
+)
+
+// ListCache keeps snapshots of LIST responses of the primary backend.
+// Group lists are big and change slowly, so they are fetched once and
+// refreshed periodically instead of being downloaded for every client.
+type ListCache struct {
+	sync.Mutex
+	lists map[string]*listSnapshot
+}
+
+type listSnapshot struct {
+	sync.Mutex // held while the first snapshot is fetched
+	lines      []string
+}
+
+func NewListCache() *ListCache {
+	return &ListCache{lists: make(map[string]*listSnapshot)}
+}
+
+func (lc *ListCache) snapshot(keyword string) *listSnapshot {
+	lc.Lock()
+	defer lc.Unlock()
+
+	s, ok := lc.lists[keyword]
+	if !ok {
+		s = &listSnapshot{}
+		lc.lists[keyword] = s
+	}
+
+	return s
+}
+
+// Get returns snapshot of list keyword, the list is fetched when there's
+// no snapshot yet, concurrent requests wait for that single fetch.
+func (lc *ListCache) Get(keyword string, fetch func(keyword string) ([]string, error)) ([]string, error) {
+	s := lc.snapshot(keyword)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lines == nil {
+		lines, err := fetch(keyword)
+		if err != nil {
+			return nil, err
+		}
+		s.lines = lines
+	}
+
+	return s.lines, nil
+}
+
+// Refresh fetches again lists which were asked for, snapshots are
+// replaced once fetched, a list failing to fetch keeps its old snapshot.
+func (lc *ListCache) Refresh(fetch func(keyword string) ([]string, error)) {
+	lc.Lock()
+	keywords := make([]string, 0, len(lc.lists))
+	for keyword := range lc.lists {
+		keywords = append(keywords, keyword)
+	}
+	lc.Unlock()
+
+	for _, keyword := range keywords {
+		lines, err := fetch(keyword)
+		if err != nil {
+			continue
+		}
+
+		s := lc.snapshot(keyword)
+		s.Lock()
+		s.lines = lines
+		s.Unlock()
+	}
+}
+
+// List returns list keyword of the primary backend from snapshot,
+// filtering is left to the caller.
+func (b *NNTPBackend) List(keyword string) ([]string, error) {
+	return b.lc.Get(keyword, b.fetchList)
+}
+
+// RefreshLists refreshes list snapshots.
+func (b *NNTPBackend) RefreshLists() {
+	b.lc.Refresh(b.fetchList)
+}
+
+func (b *NNTPBackend) fetchList(keyword string) ([]string, error) {
+	result, err := b.onPrimaryComplete("list", "", func(c *nntpclient.Client) (interface{}, error) {
+		return c.List(keyword)
+	})
+	if err != nil {
+		log.Printf("[backend] list %s: %v\n", keyword, err)
+		metrics.ListRefreshes.With(prometheus.Labels{"list": keyword, "result": "error"}).Inc()
+		return nil, err
+	}
+
+	lines := result.([]string)
+	metrics.ListRefreshes.With(prometheus.Labels{"list": keyword, "result": "ok"}).Inc()
+	metrics.ListLines.With(prometheus.Labels{"list": keyword}).Set(float64(len(lines)))
+
+	return lines, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestListCache(t *testing.T) {
+	lc := NewListCache()
+
+	fetches := 0
+	fetch := func(keyword string) ([]string, error) {
+		fetches++
+		return []string{keyword}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		lines, err := lc.Get("active", fetch)
+		if err != nil || len(lines) != 1 || lines[0] != "active" {
+			t.Fatalf("unexpected list %v: %v", lines, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected single fetch, got %d", fetches)
+	}
+
+	// only lists asked for are refreshed
+	lc.Refresh(fetch)
+	if fetches != 2 {
+		t.Errorf("expected active list refreshed only, got %d fetches", fetches)
+	}
+
+	// failed refresh keeps the snapshot
+	lc.Refresh(func(keyword string) ([]string, error) {
+		return nil, errors.New("backend down")
+	})
+	if lines, err := lc.Get("active", fetch); err != nil || len(lines) != 1 {
+		t.Errorf("snapshot lost on failed refresh: %v %v", lines, err)
+	}
+}
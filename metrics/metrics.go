@@ -27,6 +27,20 @@ var (
 		Help:      "Number of sessions",
 	})
 
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "server",
+		Name:      "auth_failures_total",
+		Help:      "Number of failed authentications by reason (password or locked)",
+	}, []string{"reason"})
+
+	ServerDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "server",
+		Name:      "disconnects_total",
+		Help:      "Number of closed sessions by reason",
+	}, []string{"reason"})
+
 	ArticleRequests = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: "nntplexer",
 		Subsystem: "nntp",
@@ -34,6 +48,20 @@ var (
 		Help:      "Number of aricles requested",
 	})
 
+	Node = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nntplexer",
+		Subsystem: "server",
+		Name:      "node",
+		Help:      "Node id backends are selected for",
+	})
+
+	BackendActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nntplexer",
+		Subsystem: "nntp",
+		Name:      "backend_active",
+		Help:      "Backends enabled on this node",
+	}, []string{"backend"})
+
 	BackendRequests = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "nntplexer",
 		Subsystem: "nntp",
@@ -41,10 +69,151 @@ var (
 		Help:      "Number of aricles fetched by backend and response code",
 	}, []string{"backend", "code"})
 
+	BackendTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "nntp",
+		Name:      "backend_timeouts_total",
+		Help:      "Number of backend connections dropped on read or write timeout",
+	}, []string{"backend", "op"})
+
+	BackendRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "nntp",
+		Name:      "backend_retries_total",
+		Help:      "Number of requests retried on the same backend after a broken connection",
+	}, []string{"backend"})
+
+	BackendScore = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nntplexer",
+		Subsystem: "nntp",
+		Name:      "backend_score",
+		Help:      "Backend score used to order backends of the same priority",
+	}, []string{"backend"})
+
+	BackendHedges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "nntp",
+		Name:      "backend_hedges_total",
+		Help:      "Number of hedged requests by backend and result (launched or won)",
+	}, []string{"backend", "result"})
+
 	BackendBytes = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "nntplexer",
 		Subsystem: "nntp",
 		Name:      "backend_bytes",
 		Help:      "Number of bytes served by backend",
 	}, []string{"backend"})
+
+	BackendSkips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "nntp",
+		Name:      "backend_skips_total",
+		Help:      "Number of times backend wasn't asked for an article by backend and reason",
+	}, []string{"backend", "reason"})
+
+	MissingCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "missing_lookups_total",
+		Help:      "Number of negative cache lookups by scope (all or backend) and result (hit or miss)",
+	}, []string{"scope", "result"})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Number of article cache lookups by result (hit or miss)",
+	}, []string{"result"})
+
+	CacheBytesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "bytes_saved_total",
+		Help:      "Number of bytes served from article cache instead of backends",
+	})
+
+	CacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "bytes",
+		Help:      "Size of cached articles by disk",
+	}, []string{"disk"})
+
+	CacheDiskUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "disk_up",
+		Help:      "Whether cache disk is usable",
+	}, []string{"disk"})
+
+	CacheDiskErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "disk_errors_total",
+		Help:      "Number of cache disk errors by disk and operation",
+	}, []string{"disk", "op"})
+
+	RemoteCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "remote_requests_total",
+		Help:      "Number of remote cache lookups by result (hit, miss or error)",
+	}, []string{"result"})
+
+	RemoteCacheUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "cache",
+		Name:      "remote_uploads_total",
+		Help:      "Number of remote cache uploads by result (ok, error or dropped)",
+	}, []string{"result"})
+
+	PoolWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nntplexer",
+		Subsystem: "pool",
+		Name:      "wait_seconds",
+		Help:      "Time spent waiting for a free backend connection",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"backend"})
+
+	PoolWaiters = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nntplexer",
+		Subsystem: "pool",
+		Name:      "waiters",
+		Help:      "Number of requests queued for a free backend connection",
+	}, []string{"backend"})
+
+	PoolBusy = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "pool",
+		Name:      "busy_total",
+		Help:      "Number of requests given up on a busy pool by reason (queue_full or timeout)",
+	}, []string{"backend", "reason"})
+
+	PoolEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "pool",
+		Name:      "evictions_total",
+		Help:      "Number of closed backend connections by reason (idle, lifetime or keepalive)",
+	}, []string{"backend", "reason"})
+
+	PoolRebuilds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "pool",
+		Name:      "rebuilds_total",
+		Help:      "Number of closed pools by reason (changed or removed backend)",
+	}, []string{"backend", "reason"})
+
+	ListRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nntplexer",
+		Subsystem: "list",
+		Name:      "refreshes_total",
+		Help:      "Number of list snapshots fetched from primary backend by result (ok or error)",
+	}, []string{"list", "result"})
+
+	ListLines = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nntplexer",
+		Subsystem: "list",
+		Name:      "lines",
+		Help:      "Number of lines in list snapshot",
+	}, []string{"list"})
 )
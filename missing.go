@@ -0,0 +1,99 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MissingCache remembers articles backends answered 430 for, so that
+// repeated requests for the same message-id don't walk the backends again.
+// Cache is bounded by number of entries, least recently used ones are
+// evicted first.
+type MissingCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type missingEntry struct {
+	key     string
+	expires time.Time
+}
+
+func NewMissingCache(ttl time.Duration, size int) *MissingCache {
+	return &MissingCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Enabled tells whether cache stores anything at all.
+func (mc *MissingCache) Enabled() bool {
+	return mc.size > 0
+}
+
+// Missing tells whether article is known to be missing on backend.
+// Empty backend stands for all backends.
+func (mc *MissingCache) Missing(backend string, messageId string) bool {
+	if !mc.Enabled() {
+		return false
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+
+	key := missingKey(backend, messageId)
+
+	element, ok := mc.entries[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(element.Value.(*missingEntry).expires) {
+		mc.remove(element)
+		return false
+	}
+
+	mc.lru.MoveToFront(element)
+	return true
+}
+
+// Add marks article as missing on backend.
+// Empty backend stands for all backends.
+func (mc *MissingCache) Add(backend string, messageId string) {
+	if !mc.Enabled() {
+		return
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+
+	key := missingKey(backend, messageId)
+	expires := time.Now().Add(mc.ttl)
+
+	if element, ok := mc.entries[key]; ok {
+		element.Value.(*missingEntry).expires = expires
+		mc.lru.MoveToFront(element)
+		return
+	}
+
+	mc.entries[key] = mc.lru.PushFront(&missingEntry{key: key, expires: expires})
+
+	for mc.lru.Len() > mc.size {
+		mc.remove(mc.lru.Back())
+	}
+}
+
+func (mc *MissingCache) remove(element *list.Element) {
+	mc.lru.Remove(element)
+	delete(mc.entries, element.Value.(*missingEntry).key)
+}
+
+func missingKey(backend string, messageId string) string {
+	return backend + " " + messageId
+}
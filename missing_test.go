@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMissingCache(t *testing.T) {
+	mc := NewMissingCache(time.Minute, 2)
+
+	mc.Add("", "<a@x>")
+	mc.Add("giga", "<b@x>")
+
+	if !mc.Missing("", "<a@x>") {
+		t.Error("<a@x> expected missing everywhere")
+	}
+	if mc.Missing("", "<b@x>") {
+		t.Error("<b@x> is only missing on giga")
+	}
+	if !mc.Missing("giga", "<b@x>") {
+		t.Error("<b@x> expected missing on giga")
+	}
+
+	// <a@x> is the least recently used one now
+	mc.Missing("giga", "<b@x>")
+	mc.Add("", "<c@x>")
+
+	if mc.Missing("", "<a@x>") {
+		t.Error("<a@x> expected to be evicted")
+	}
+	if !mc.Missing("giga", "<b@x>") || !mc.Missing("", "<c@x>") {
+		t.Error("recently used entries evicted")
+	}
+}
+
+func TestMissingCacheTtl(t *testing.T) {
+	mc := NewMissingCache(time.Millisecond, 10)
+
+	mc.Add("", "<a@x>")
+	time.Sleep(5 * time.Millisecond)
+
+	if mc.Missing("", "<a@x>") {
+		t.Error("expired entry reported missing")
+	}
+	if len(mc.entries) != 0 {
+		t.Error("expired entry not removed")
+	}
+}
+
+func TestMissingCacheDisabled(t *testing.T) {
+	mc := NewMissingCache(time.Minute, 0)
+
+	mc.Add("", "<a@x>")
+	if mc.Missing("", "<a@x>") {
+		t.Error("disabled cache reported missing article")
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"log"
+	"nntplexer/metrics"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,6 +20,14 @@ type User struct {
 	MaxConns  uint16 `gorm:"not null;default:0"`
 	IpSharing bool	 `gorm:"not null;default:0"`
 	RxBytes   uint64 `gorm:"not null;default:0"`
+
+	// Quota limits bytes downloaded in a period of QuotaPeriod days,
+	// PeriodBytes counts bytes downloaded in the current one. With zero
+	// QuotaPeriod the period never ends, making Quota a total allowance.
+	Quota       uint64 `gorm:"not null;default:0"` // 0 means unlimited
+	QuotaPeriod uint16 `gorm:"not null;default:0"`
+	PeriodBytes uint64 `gorm:"not null;default:0"`
+	PeriodStart *time.Time
 }
 
 type Backend struct {
@@ -22,14 +37,76 @@ type Backend struct {
 	Host           string
 	Port           uint16
 	UseTLS         bool
-	Retention      uint16
+	Retention      uint16 // days, 0 means unlimited
 	Priority       uint16
 	MaxConns       uint16
+	MaxWait        uint32 `gorm:"not null;default:0"` // milliseconds to wait for a free connection, 0 means no waiting
+	MaxWaiters     uint16 `gorm:"not null;default:0"` // requests queued for a free connection, 0 means MaxConns
 	MaxFails       uint16
 	FailTimeout    uint16
-	ConnectTimeout uint32
+	IdleTimeout    uint32 `gorm:"not null;default:0"` // seconds idle connection is closed after, 0 means never
+	MaxLifetime    uint32 `gorm:"not null;default:0"` // seconds connection is closed after, 0 means never
+	Keepalive      uint32 `gorm:"not null;default:0"` // seconds idle connection is probed with DATE after, 0 disables probes
+	MinIdle        uint16 `gorm:"not null;default:0"` // idle connections kept open in advance
+	ConnectTimeout uint32 // milliseconds
+	ReadTimeout    uint32 `gorm:"not null;default:0"` // milliseconds, 0 means no timeout
+	WriteTimeout   uint32 `gorm:"not null;default:0"` // milliseconds, 0 means no timeout
+	CommandTimeout uint32 `gorm:"not null;default:0"` // milliseconds a whole command may take, 0 means no timeout
 	Enabled        bool
-	Node           uint32
+	Node           string `gorm:"size:64;not null;default:all"` // comma separated node ids backend is used on, or all
+	Tags           string // comma separated, used by routing rules
+	Overview       bool   `gorm:"not null;default:0"` // serves OVER and HDR, needs to be primary for ranges
+	RxBytes        uint64 `gorm:"not null;default:0"`
+}
+
+// OnNode tells whether backend is used on node.
+func (b Backend) OnNode(node uint32) bool {
+	id := strconv.FormatUint(uint64(node), 10)
+	for _, n := range strings.Split(b.Node, ",") {
+		n = strings.TrimSpace(n)
+		if strings.EqualFold(n, "all") || n == id {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTag tells whether backend is tagged with tag.
+func (b Backend) HasTag(tag string) bool {
+	for _, t := range strings.Split(b.Tags, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule is a routing rule, see Router for details.
+type Rule struct {
+	ID        uint   `gorm:"primaryKey"`
+	Priority  uint16 `gorm:"not null;default:0"`
+	Command   string `gorm:"size:64"`            // comma separated commands, empty matches any
+	MessageId string `gorm:"size:250"`           // regexp, empty matches any
+	Domain    string `gorm:"size:250"`           // message-id domain or its parent, empty matches any
+	Negate    bool   `gorm:"not null;default:0"` // rule applies when message-id doesn't match
+	Backend   string `gorm:"size:250"`           // regexp for backend name, empty matches any
+	Tag       string `gorm:"size:32"`            // backend tag, empty matches any
+	Action    string `gorm:"size:8"`             // skip, prefer or only
+	Enabled   bool   `gorm:"not null;default:0"`
+
+	messageId *regexp.Regexp
+	backend   *regexp.Regexp
+}
+
+// defaultRules are equivalents of checks which were hardcoded before
+// routing rules: giganews and xsnews articles are kept off backends of the
+// same name, bodies from uploaders ninja mishandles are kept off it.
+func defaultRules() []Rule {
+	return []Rule{
+		{Priority: 10, MessageId: "giganews", Backend: "giga", Action: RuleSkip, Enabled: true},
+		{Priority: 20, MessageId: "xsnews", Backend: "xsnews", Action: RuleSkip, Enabled: true},
+		{Priority: 30, Command: "body", MessageId: `-newzNZB-|astraweb|easyusenet|camelsystem-powerpost\.local|@nyuu|@PRiVATE`, Negate: true, Backend: "ninja", Action: RuleSkip, Enabled: true},
+	}
 }
 
 type Article struct {
@@ -47,6 +124,12 @@ type UserRepository struct {
 func (ur *UserRepository) Refresh() {
 	var users []User
 	result := ur.db.Find(&users)
+	if result.Error != nil {
+		// keep the last known users, nobody could log in otherwise
+		log.Printf("[users] refresh: %v\n", result.Error)
+		return
+	}
+
 	ur.Lock()
 	defer ur.Unlock()
 
@@ -62,26 +145,128 @@ func (ur *UserRepository) Get(user string) User {
 	return ur.users[user]
 }
 
-func (ur *UserRepository) Stats(user string, rx int64, tx int64) {
-	ur.db.Exec("UPDATE users SET rx_bytes = rx_bytes + ? WHERE name = ?", rx, user)
+// SetPassword stores new password hash for user.
+func (ur *UserRepository) SetPassword(user string, pass string) error {
+	hash, err := HashPassword(pass)
+	if err != nil {
+		return err
+	}
+
+	result := ur.db.Model(&User{}).Where("name = ?", user).Update("pass", hash)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("user %s not found", user)
+	}
+
+	ur.Lock()
+	defer ur.Unlock()
+
+	if u, ok := ur.users[user]; ok {
+		u.Pass = hash
+		ur.users[user] = u
+	}
+
+	return nil
+}
+
+func (ur *UserRepository) Stats(user string, rx int64, tx int64) error {
+	result := ur.db.Exec("UPDATE users SET rx_bytes = rx_bytes + ?, period_bytes = period_bytes + ? WHERE name = ?", rx, rx, user)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// keep cached usage current till the next refresh
+	ur.Lock()
+	defer ur.Unlock()
+
+	if u, ok := ur.users[user]; ok {
+		u.RxBytes += uint64(rx)
+		u.PeriodBytes += uint64(rx)
+		ur.users[user] = u
+	}
+
+	return nil
+}
+
+// ResetPeriods starts a new quota period for users whose current one is over.
+// Database is updated without holding the lock, quota checks of every
+// session would wait for it otherwise.
+func (ur *UserRepository) ResetPeriods(now time.Time) {
+	var due []string
+
+	ur.RLock()
+	for name, u := range ur.users {
+		if u.QuotaPeriod == 0 {
+			continue
+		}
+		if u.PeriodStart != nil && now.Sub(*u.PeriodStart) < time.Duration(u.QuotaPeriod)*24*time.Hour {
+			continue
+		}
+		due = append(due, name)
+	}
+	ur.RUnlock()
+
+	for _, name := range due {
+		result := ur.db.Model(&User{}).Where("name = ?", name).Updates(map[string]interface{}{
+			"period_bytes": 0,
+			"period_start": now,
+		})
+		if result.Error != nil {
+			log.Printf("[users] [%s] quota period reset: %v\n", name, result.Error)
+			continue
+		}
+
+		ur.Lock()
+		if u, ok := ur.users[name]; ok {
+			u.PeriodBytes = 0
+			u.PeriodStart = &now
+			ur.users[name] = u
+		}
+		ur.Unlock()
+	}
 }
 
 type BackendRepository struct {
 	sync.RWMutex
 	db       *gorm.DB
+	node     uint32 // backends of other nodes are ignored
 	backends []Backend
 }
 
 func (br *BackendRepository) Refresh() {
 	var backends []Backend
-	result := br.db.Order("priority").Where(&Backend{Enabled: true}).Where(&Backend{Node: 2}).Find(&backends)
+	result := br.db.Order("priority").Where(&Backend{Enabled: true}).Find(&backends)
+	if result.Error != nil {
+		// keep the last known backends, pools would be torn down otherwise
+		log.Printf("[backends] refresh: %v\n", result.Error)
+		return
+	}
+
 	br.Lock()
 	defer br.Unlock()
 
-	br.backends = make([]Backend, result.RowsAffected)
-	for index, backend := range backends {
-		br.backends[index] = backend
+	active := make([]Backend, 0, len(backends))
+	for _, backend := range backends {
+		if backend.OnNode(br.node) {
+			active = append(active, backend)
+		}
+	}
+
+	for _, backend := range br.backends {
+		metrics.BackendActive.Delete(prometheus.Labels{"backend": backend.Name})
+	}
+	for _, backend := range active {
+		metrics.BackendActive.With(prometheus.Labels{"backend": backend.Name}).Set(1)
 	}
+
+	br.backends = active
+}
+
+// Node returns node id backends are selected for.
+func (br *BackendRepository) Node() uint32 {
+	return br.node
 }
 
 func (br *BackendRepository) Get() []Backend {
@@ -91,8 +276,45 @@ func (br *BackendRepository) Get() []Backend {
 	return br.backends
 }
 
-func (br *BackendRepository) Stats(name string, tx int64, rx int64) {
-	// TODO
+func (br *BackendRepository) Stats(name string, rx int64) error {
+	return br.db.Exec("UPDATE backends SET rx_bytes = rx_bytes + ? WHERE name = ?", rx, name).Error
+}
+
+type RuleRepository struct {
+	sync.RWMutex
+	db    *gorm.DB
+	rules []Rule
+}
+
+func (rr *RuleRepository) Refresh() {
+	var rules []Rule
+	result := rr.db.Order("priority").Order("id").Where(&Rule{Enabled: true}).Find(&rules)
+	if result.Error != nil {
+		// keep the last known rules, skips would be lifted otherwise
+		log.Printf("[rules] refresh: %v\n", result.Error)
+		return
+	}
+
+	compiled := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			log.Printf("[rules] rule %d ignored: %v\n", rule.ID, err)
+			continue
+		}
+		compiled = append(compiled, rule)
+	}
+
+	rr.Lock()
+	defer rr.Unlock()
+
+	rr.rules = compiled
+}
+
+func (rr *RuleRepository) Get() []Rule {
+	rr.RLock()
+	defer rr.RUnlock()
+
+	return rr.rules
 }
 
 type ArticleRepository struct {
@@ -109,21 +331,30 @@ func (ar *ArticleRepository) Cleanup(ttl int) {
 
 func (ar *ArticleRepository) Get(id string) *Article {
 	var article Article
-	_ = ar.db.FirstOrInit(&article, id)
+	_ = ar.db.Where("message_id = ?", id).FirstOrInit(&article)
 	return &article
 }
 
-func (ar *ArticleRepository) Create(id string, ts time.Time) error {
+// Date returns known post date of an article.
+func (ar *ArticleRepository) Date(id string) (time.Time, bool) {
+	article := ar.Get(id)
+	return article.Date, !article.Date.IsZero()
+}
+
+// CreateBatch stores post dates of articles, dates known already
+// are kept, their articles are just marked as fresh again.
+func (ar *ArticleRepository) CreateBatch(dates map[string]time.Time) error {
 	now := time.Now()
 
+	articles := make([]Article, 0, len(dates))
+	for id, ts := range dates {
+		articles = append(articles, Article{MessageId: id, Date: ts, CreatedAt: now})
+	}
+
 	result := ar.db.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "message_id"}},
 		DoUpdates: clause.Assignments(map[string]interface{}{"created_at": now}),
-	}).Create(&Article{
-		MessageId: id,
-		Date:      ts,
-		CreatedAt: now,
-	})
+	}).CreateInBatches(articles, 500)
 
 	return result.Error
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackendOnNode(t *testing.T) {
+	tests := []struct {
+		node     string
+		expected bool
+	}{
+		{"2", true},
+		{"10, 2", true},
+		{"all", true},
+		{"10", false},
+		{"20", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if on := (Backend{Node: test.node}).OnNode(2); on != test.expected {
+			t.Errorf("node %q: expected %v, got %v", test.node, test.expected, on)
+		}
+	}
+}
+
+// fakeDb stands in for database connection, statements are recorded
+// and succeed unless err is set, queries always fail.
+type fakeDb struct {
+	sync.Mutex
+	execs  []string
+	err    error
+	onExec func()
+}
+
+func newFakeDb(t *testing.T) (*gorm.DB, *fakeDb) {
+	fd := &fakeDb{}
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: fd, SkipInitializeWithVersion: true}), &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, fd
+}
+
+func (fd *fakeDb) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, errors.New("prepared statements not supported")
+}
+
+func (fd *fakeDb) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	fd.Lock()
+	fd.execs = append(fd.execs, query)
+	err, onExec := fd.err, fd.onExec
+	fd.Unlock()
+
+	if onExec != nil {
+		onExec()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (fd *fakeDb) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("database is down")
+}
+
+func (fd *fakeDb) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+// executed returns number of statements run so far.
+func (fd *fakeDb) executed() int {
+	fd.Lock()
+	defer fd.Unlock()
+	return len(fd.execs)
+}
+
+func TestResetPeriods(t *testing.T) {
+	db, fd := newFakeDb(t)
+
+	now := time.Now()
+	recent := now.Add(-24 * time.Hour)
+	old := now.Add(-31 * 24 * time.Hour)
+	ur := &UserRepository{db: db, users: map[string]User{
+		"new":     {Name: "new", QuotaPeriod: 30, PeriodBytes: 100},
+		"over":    {Name: "over", QuotaPeriod: 30, PeriodBytes: 100, PeriodStart: &old},
+		"current": {Name: "current", QuotaPeriod: 30, PeriodBytes: 100, PeriodStart: &recent},
+		"total":   {Name: "total", Quota: 1000, PeriodBytes: 100},
+	}}
+
+	// quota checks go on while database is updated
+	fd.onExec = func() {
+		done := make(chan struct{})
+		go func() {
+			ur.Get("current")
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("users locked during database update")
+		}
+	}
+
+	ur.ResetPeriods(now)
+
+	if fd.executed() != 2 {
+		t.Errorf("expected 2 updates, got %d", fd.executed())
+	}
+	for _, name := range []string{"new", "over"} {
+		if u := ur.Get(name); u.PeriodBytes != 0 || u.PeriodStart == nil || !u.PeriodStart.Equal(now) {
+			t.Errorf("%s: expected new period, got %d bytes since %v", name, u.PeriodBytes, u.PeriodStart)
+		}
+	}
+	for _, name := range []string{"current", "total"} {
+		if u := ur.Get(name); u.PeriodBytes != 100 {
+			t.Errorf("%s: expected period kept, got %d bytes", name, u.PeriodBytes)
+		}
+	}
+}
+
+func TestResetPeriodsFailed(t *testing.T) {
+	db, fd := newFakeDb(t)
+	fd.err = errors.New("database is down")
+
+	ur := &UserRepository{db: db, users: map[string]User{
+		"new": {Name: "new", QuotaPeriod: 30, PeriodBytes: 100},
+	}}
+
+	ur.ResetPeriods(time.Now())
+
+	if u := ur.Get("new"); u.PeriodBytes != 100 || u.PeriodStart != nil {
+		t.Errorf("period reset in cache only, got %d bytes since %v", u.PeriodBytes, u.PeriodStart)
+	}
+}
+
+func TestRuleRepositoryRefreshFailed(t *testing.T) {
+	db, _ := newFakeDb(t)
+	rr := &RuleRepository{db: db, rules: defaultRules()}
+
+	rr.Refresh()
+
+	if len(rr.Get()) != 3 {
+		t.Errorf("expected last known rules kept, got %d", len(rr.Get()))
+	}
+}
@@ -9,3 +9,11 @@ type Article struct {
 	Headers textproto.MIMEHeader
 	Body    io.Reader
 }
+
+// Group is a newsgroup as selected by GROUP command.
+type Group struct {
+	Name  string
+	Count int64 // estimated number of articles
+	Low   int64 // reported low water mark
+	High  int64 // reported high water mark
+}
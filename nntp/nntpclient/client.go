@@ -1,23 +1,36 @@
 package nntpclient
 
 import (
+	"bufio"
 	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"nntplexer/nntp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Client struct {
 	text    *textproto.Conn
+	conn    *deadlineConn
 	config  *Config
 	code    int
 	message string
+	// caps are capabilities advertised by server, labels mapped to
+	// their arguments, nil till asked for
+	caps map[string][]string
 }
 
+// Config holds connection settings, timeouts are in milliseconds,
+// 0 disables a timeout. Read and write timeouts bound each wait for the
+// server, command timeout bounds a whole command including its response.
 type Config struct {
-	ReadTimeout    int // TODO
-	WriteTimeout   int // TODO
+	ReadTimeout    int
+	WriteTimeout   int
+	CommandTimeout int
 	ConnectTimeout int
 	Encryption     bool
 }
@@ -47,13 +60,25 @@ func Dial(addr string, config *Config) (*Client, error) {
 }
 
 func NewClient(conn net.Conn, config *Config) (*Client, error) {
-	text := textproto.NewConn(conn)
+	dc := &deadlineConn{
+		Conn:           conn,
+		readTimeout:    time.Duration(config.ReadTimeout) * time.Millisecond,
+		writeTimeout:   time.Duration(config.WriteTimeout) * time.Millisecond,
+		commandTimeout: time.Duration(config.CommandTimeout) * time.Millisecond,
+	}
+	text := textproto.NewConn(dc)
+
+	// greeting is bound by command timeout as well
+	dc.begin()
 	code, message, err := text.ReadCodeLine(20)
+	dc.end()
 	if err != nil {
+		_ = text.Close()
 		return nil, err
 	}
 	c := &Client{
 		text:    text,
+		conn:    dc,
 		config:  config,
 		code:    code,
 		message: message,
@@ -77,11 +102,47 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) Capabilities() ([]string, error) {
-	if err := c.Cmd(101, "CAPABILITIES"); err != nil {
+	if err := c.multiCmd(101, "CAPABILITIES"); err != nil {
 		return nil, err
 	}
 
-	return c.text.ReadDotLines()
+	return c.readDotLines()
+}
+
+// HasCapability tells whether server advertises capability label, e.g.
+// "OVER", and optionally its argument, e.g. "MSGID". Capabilities are
+// asked for once per connection, servers not knowing CAPABILITIES are
+// assumed to have none.
+func (c *Client) HasCapability(label string, arg string) (bool, error) {
+	if c.caps == nil {
+		lines, err := c.Capabilities()
+		if tperr, ok := err.(*textproto.Error); ok && tperr.Code >= 500 {
+			lines, err = nil, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		c.caps = make(map[string][]string, len(lines))
+		for _, line := range lines {
+			fields := strings.Fields(strings.ToUpper(line))
+			if len(fields) > 0 {
+				c.caps[fields[0]] = fields[1:]
+			}
+		}
+	}
+
+	args, ok := c.caps[strings.ToUpper(label)]
+	if !ok || arg == "" {
+		return ok, nil
+	}
+	for _, a := range args {
+		if a == strings.ToUpper(arg) {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 func (c *Client) Authenticate(user string, pass string) (bool, error) {
@@ -97,33 +158,246 @@ func (c *Client) Authenticate(user string, pass string) (bool, error) {
 }
 
 func (c *Client) Article(id string) (*nntp.Article, error) {
-	if err := c.Cmd(220, "ARTICLE "+id); err != nil {
+	if err := c.multiCmd(220, "ARTICLE "+id); err != nil {
 		return nil, err
 	}
 
 	header, err := c.text.ReadMIMEHeader()
 	if err != nil {
+		c.conn.end()
 		return nil, err
 	}
 
 	return &nntp.Article{
 		Headers: header,
-		Body:    c.text.DotReader(),
+		Body:    c.dotReader(),
 	}, nil
 }
 
 func (c *Client) Body(id string) (*nntp.Article, error) {
-	if err := c.Cmd(222, "BODY "+id); err != nil {
+	if err := c.multiCmd(222, "BODY "+id); err != nil {
 		return nil, err
 	}
 
 	return &nntp.Article{
 		Headers: make(textproto.MIMEHeader),
-		Body:    c.text.DotReader(),
+		Body:    c.dotReader(),
 	}, nil
 }
 
+// Head fetches article headers only.
+func (c *Client) Head(id string) (textproto.MIMEHeader, error) {
+	if err := c.multiCmd(221, "HEAD "+id); err != nil {
+		return nil, err
+	}
+
+	// headers block is dot terminated and has no trailing empty line,
+	// so ReadMIMEHeader ends with io.EOF on success
+	dr := c.dotReader()
+	header, err := textproto.NewReader(bufio.NewReader(dr)).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		c.conn.end()
+		return nil, err
+	}
+
+	// consume whatever is left till the terminating dot
+	if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// Stat checks article existence without fetching it.
+func (c *Client) Stat(id string) error {
+	return c.Cmd(223, "STAT "+id)
+}
+
+// Group selects newsgroup.
+func (c *Client) Group(name string) (nntp.Group, error) {
+	if err := c.Cmd(211, "GROUP "+name); err != nil {
+		return nntp.Group{}, err
+	}
+
+	return parseGroup(c.message)
+}
+
+// ListGroup selects newsgroup and lists its article numbers within
+// rng, e.g. "100-200" or "100-", empty rng lists all of them.
+func (c *Client) ListGroup(name string, rng string) (nntp.Group, []int64, error) {
+	cmd := "LISTGROUP " + name
+	if rng != "" {
+		cmd += " " + rng
+	}
+
+	if err := c.multiCmd(211, cmd); err != nil {
+		return nntp.Group{}, nil, err
+	}
+
+	group, err := parseGroup(c.message)
+	if err != nil {
+		// the list follows anyway, keep connection usable
+		_, _ = c.readDotLines()
+		return nntp.Group{}, nil, err
+	}
+
+	lines, err := c.readDotLines()
+	if err != nil {
+		return nntp.Group{}, nil, err
+	}
+
+	numbers := make([]int64, 0, len(lines))
+	for _, line := range lines {
+		number, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err != nil {
+			return nntp.Group{}, nil, textproto.ProtocolError("invalid article number: " + line)
+		}
+		numbers = append(numbers, number)
+	}
+
+	return group, numbers, nil
+}
+
+// Next moves current article pointer of selected group forward,
+// returns number and message-id of the article it points to.
+func (c *Client) Next() (int64, string, error) {
+	if err := c.Cmd(223, "NEXT"); err != nil {
+		return 0, "", err
+	}
+
+	return c.ArticlePointer()
+}
+
+// Last moves current article pointer of selected group backward.
+func (c *Client) Last() (int64, string, error) {
+	if err := c.Cmd(223, "LAST"); err != nil {
+		return 0, "", err
+	}
+
+	return c.ArticlePointer()
+}
+
+// ArticlePointer parses article number and message-id of the last
+// ARTICLE, HEAD, BODY, STAT, NEXT or LAST response.
+func (c *Client) ArticlePointer() (int64, string, error) {
+	fields := strings.Fields(c.message)
+	if len(fields) < 2 {
+		return 0, "", textproto.ProtocolError("invalid response: " + c.message)
+	}
+
+	number, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, "", textproto.ProtocolError("invalid article number: " + fields[0])
+	}
+
+	return number, fields[1], nil
+}
+
+func parseGroup(message string) (nntp.Group, error) {
+	fields := strings.Fields(message)
+	if len(fields) < 4 {
+		return nntp.Group{}, textproto.ProtocolError("invalid group response: " + message)
+	}
+
+	var numbers [3]int64
+	for i := range numbers {
+		number, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nntp.Group{}, textproto.ProtocolError("invalid group response: " + message)
+		}
+		numbers[i] = number
+	}
+
+	return nntp.Group{Name: fields[3], Count: numbers[0], Low: numbers[1], High: numbers[2]}, nil
+}
+
+// Over streams overview of articles in rng of selected group, or of
+// a single article given by message-id. Servers without OVER capability
+// are asked with XOVER, which doesn't take message-ids.
+func (c *Client) Over(rng string) (io.Reader, error) {
+	cmd := "XOVER"
+	ok, err := c.HasCapability("OVER", "")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cmd = "OVER"
+	}
+
+	if rng != "" {
+		cmd += " " + rng
+	}
+	if err := c.multiCmd(224, cmd); err != nil {
+		return nil, err
+	}
+
+	return c.dotReader(), nil
+}
+
+// Hdr streams values of header field of articles in rng of selected
+// group, or of a single article given by message-id. Servers without
+// HDR capability are asked with XHDR.
+func (c *Client) Hdr(field string, rng string) (io.Reader, error) {
+	cmd, code := "XHDR", 221
+	ok, err := c.HasCapability("HDR", "")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cmd, code = "HDR", 225
+	}
+
+	cmd += " " + field
+	if rng != "" {
+		cmd += " " + rng
+	}
+	if err := c.multiCmd(code, cmd); err != nil {
+		return nil, err
+	}
+
+	return c.dotReader(), nil
+}
+
+// List fetches list keyword, e.g. "ACTIVE" or "NEWSGROUPS".
+func (c *Client) List(keyword string) ([]string, error) {
+	if err := c.multiCmd(215, "LIST "+strings.ToUpper(keyword)); err != nil {
+		return nil, err
+	}
+
+	return c.readDotLines()
+}
+
+// Date fetches server time, being cheap it also serves as a keepalive probe.
+func (c *Client) Date() (time.Time, error) {
+	if err := c.Cmd(111, "DATE"); err != nil {
+		return time.Time{}, err
+	}
+
+	fields := strings.Fields(c.message)
+	if len(fields) == 0 {
+		return time.Time{}, textproto.ProtocolError("missing date: " + c.message)
+	}
+
+	return time.Parse("20060102150405", fields[0])
+}
+
+// Cmd sends cmd and reads its single-line response.
 func (c *Client) Cmd(expectCode int, cmd string) error {
+	defer c.conn.end()
+	return c.multiCmd(expectCode, cmd)
+}
+
+// multiCmd sends cmd and reads status line of its response, command
+// deadline is left running for the rest of the response when the
+// command succeeds, which dotReader or readDotLines end.
+func (c *Client) multiCmd(expectCode int, cmd string) (err error) {
+	c.conn.begin()
+	defer func() {
+		if err != nil {
+			c.conn.end()
+		}
+	}()
+
 	id, err := c.text.Cmd(cmd)
 	if err != nil {
 		return err
@@ -141,3 +415,14 @@ func (c *Client) Cmd(expectCode int, cmd string) error {
 
 	return nil
 }
+
+// dotReader reads dot-encoded rest of response, ending the command.
+func (c *Client) dotReader() io.Reader {
+	return &endReader{r: c.text.DotReader(), conn: c.conn}
+}
+
+// readDotLines reads dot-encoded lines of rest of response, ending the command.
+func (c *Client) readDotLines() ([]string, error) {
+	defer c.conn.end()
+	return c.text.ReadDotLines()
+}
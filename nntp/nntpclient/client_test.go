@@ -2,7 +2,13 @@ package nntpclient
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"nntplexer/nntp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDial(t *testing.T) {
@@ -44,3 +50,249 @@ func TestDialTls(t *testing.T) {
 
 	fmt.Println(capabilities)
 }
+
+// pipeClient connects Client to a fake server answering each
+// received command with the next canned response.
+func pipeClient(t *testing.T, responses ...string) *Client {
+	server, conn := net.Pipe()
+
+	go func() {
+		text := textproto.NewConn(server)
+		defer text.Close()
+
+		if err := text.PrintfLine("200 fake server ready"); err != nil {
+			return
+		}
+		for _, response := range responses {
+			if _, err := text.ReadLine(); err != nil {
+				return
+			}
+			if _, err := text.W.WriteString(response); err != nil {
+				return
+			}
+			if err := text.W.Flush(); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := NewClient(conn, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestHead(t *testing.T) {
+	c := pipeClient(t,
+		"221 0 <a@b>\r\nSubject: test\r\nDate: Mon, 2 Jan 2006 15:04:05 -0700\r\n.\r\n",
+		"223 0 <a@b>\r\n",
+	)
+	defer c.Close()
+
+	header, err := c.Head("<a@b>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Get("Subject") != "test" {
+		t.Errorf("unexpected Subject: %q", header.Get("Subject"))
+	}
+
+	// connection must be usable after headers block
+	if err := c.Stat("<a@b>"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatNotFound(t *testing.T) {
+	c := pipeClient(t, "430 No such article\r\n")
+	defer c.Close()
+
+	err := c.Stat("<a@b>")
+	if tperr, ok := err.(*textproto.Error); !ok || tperr.Code != 430 {
+		t.Fatalf("expected 430, got: %v", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		text := textproto.NewConn(server)
+		_ = text.PrintfLine("200 fake server ready")
+		// swallow commands without ever answering
+		for {
+			if _, err := text.ReadLine(); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := NewClient(conn, &Config{ReadTimeout: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	err = c.Stat("<a@b>")
+	if !IsTimeout(err) {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		text := textproto.NewConn(server)
+		_ = text.PrintfLine("200 fake server ready")
+		if _, err := text.ReadLine(); err != nil {
+			return
+		}
+		// trickle a body slowly enough for read timeout never to trip
+		_ = text.PrintfLine("222 0 <a@b>")
+		for {
+			time.Sleep(10 * time.Millisecond)
+			if err := text.PrintfLine("line"); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := NewClient(conn, &Config{ReadTimeout: 50, CommandTimeout: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	article, err := c.Body("<a@b>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(article.Body)
+	if !IsTimeout(err) {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+}
+
+func TestCommandTimeoutCleared(t *testing.T) {
+	c := pipeClient(t, "223 0 <a@b>\r\n", "111 20240102030405\r\n")
+	c.conn.commandTimeout = 50 * time.Millisecond
+
+	if err := c.Stat("<a@b>"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.conn.deadline.IsZero() {
+		t.Fatal("command deadline left running after response")
+	}
+
+	// an idle connection outlives command timeout
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Date(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDate(t *testing.T) {
+	c := pipeClient(t, "111 20210615123456\r\n")
+	defer c.Close()
+
+	date, err := c.Date()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := time.Date(2021, 6, 15, 12, 34, 56, 0, time.UTC); !date.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, date)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	c := pipeClient(t,
+		"211 1234 3000234 3002322 misc.test\r\n",
+		"211 3 100 102 misc.test list follows\r\n100\r\n101\r\n102\r\n.\r\n",
+		"223 101 <b@c> retrieved\r\n",
+	)
+	defer c.Close()
+
+	group, err := c.Group("misc.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (nntp.Group{Name: "misc.test", Count: 1234, Low: 3000234, High: 3002322}); group != expected {
+		t.Errorf("expected %+v, got %+v", expected, group)
+	}
+
+	group, numbers, err := c.ListGroup("misc.test", "100-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Count != 3 || len(numbers) != 3 || numbers[2] != 102 {
+		t.Errorf("unexpected listing %+v %v", group, numbers)
+	}
+
+	number, id, err := c.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != 101 || id != "<b@c>" {
+		t.Errorf("unexpected pointer %d %s", number, id)
+	}
+}
+
+func TestOver(t *testing.T) {
+	c := pipeClient(t,
+		"101 Capability list:\r\nVERSION 2\r\nREADER\r\nHDR\r\nOVER MSGID\r\n.\r\n",
+		"224 Overview information follows\r\n3000234\tI am just a test article\r\n.\r\n",
+		"225 Headers follow\r\n3000234 I am just a test article\r\n.\r\n",
+	)
+	defer c.Close()
+
+	if ok, err := c.HasCapability("over", "msgid"); err != nil || !ok {
+		t.Fatalf("OVER MSGID not detected: %v", err)
+	}
+
+	r, err := c.Over("3000234-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil || string(data) != "3000234\tI am just a test article\n" {
+		t.Errorf("unexpected overview %q: %v", data, err)
+	}
+
+	r, err = c.Hdr("Subject", "3000234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadAll(r); err != nil || !strings.HasPrefix(string(data), "3000234 ") {
+		t.Errorf("unexpected headers %q: %v", data, err)
+	}
+}
+
+func TestOverFallback(t *testing.T) {
+	c := pipeClient(t,
+		"500 What?\r\n",
+		"224 Overview information follows\r\n.\r\n",
+	)
+	defer c.Close()
+
+	if _, err := c.Over(""); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.HasCapability("OVER", ""); ok {
+		t.Error("capability of server without CAPABILITIES")
+	}
+}
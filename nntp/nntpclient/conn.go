@@ -0,0 +1,126 @@
+package nntpclient
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// TimeoutError reports an upstream server which didn't answer or accept
+// data in time. Connection is in an unknown state after it and must not
+// be used anymore.
+type TimeoutError struct {
+	Op  string // read or write
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "nntpclient: " + e.Op + " timeout: " + e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout makes TimeoutError a net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary makes TimeoutError a net.Error.
+func (e *TimeoutError) Temporary() bool {
+	return false
+}
+
+// IsTimeout tells whether err was caused by an expired read or write deadline.
+func IsTimeout(err error) bool {
+	var te *TimeoutError
+	return errors.As(err, &te)
+}
+
+// deadlineConn renews read or write deadline before every operation,
+// so timeouts bound the time spent waiting for the server rather than
+// the time a whole command takes, a large body is fine as long as it
+// keeps coming. A server trickling data never trips them though, so the
+// command timeout bounds a whole command, from sending it till the end
+// of its response, on top of them.
+type deadlineConn struct {
+	net.Conn
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	commandTimeout time.Duration
+
+	// deadline of the command in progress, zero when there is none
+	deadline time.Time
+}
+
+// begin starts command deadline.
+func (c *deadlineConn) begin() {
+	if c.commandTimeout > 0 {
+		c.deadline = time.Now().Add(c.commandTimeout)
+	}
+}
+
+// end clears command deadline once response is complete.
+func (c *deadlineConn) end() {
+	c.deadline = time.Time{}
+}
+
+// until returns the earlier of timeout from now and command deadline,
+// zero when neither applies.
+func (c *deadlineConn) until(timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if !c.deadline.IsZero() && (t.IsZero() || c.deadline.Before(t)) {
+		t = c.deadline
+	}
+	return t
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 || c.commandTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(c.until(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.Conn.Read(p)
+	return n, timeoutError("read", err)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 || c.commandTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(c.until(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.Conn.Write(p)
+	return n, timeoutError("write", err)
+}
+
+// endReader ends command once its multi-line response is read up,
+// or reading it failed.
+type endReader struct {
+	r    io.Reader
+	conn *deadlineConn
+}
+
+func (r *endReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		r.conn.end()
+	}
+	return n, err
+}
+
+func timeoutError(op string, err error) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return &TimeoutError{Op: op, Err: err}
+	}
+	return err
+}
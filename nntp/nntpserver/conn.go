@@ -0,0 +1,60 @@
+package nntpserver
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errLineTooLong = errors.New("command line too long")
+
+// sessionConn guards a client connection: every write has to complete
+// within writeTimeout and no line may be longer than maxLine bytes.
+type sessionConn struct {
+	net.Conn
+	writeTimeout time.Duration
+	maxLine      int
+	// bytes read since the last line feed
+	line int
+	// set once a line got too long, the rest of input is unusable then
+	tooLong bool
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	if c.tooLong {
+		return 0, errLineTooLong
+	}
+
+	n, err := c.Conn.Read(p)
+
+	if c.maxLine > 0 {
+		for _, b := range p[:n] {
+			if b == '\n' {
+				c.line = 0
+				continue
+			}
+			c.line++
+			if c.line > c.maxLine {
+				c.tooLong = true
+				return 0, errLineTooLong
+			}
+		}
+	}
+
+	return n, err
+}
+
+func (c *sessionConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+// isTimeout tells whether err is a deadline being exceeded.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
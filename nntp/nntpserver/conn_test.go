@@ -0,0 +1,104 @@
+package nntpserver
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type greetingBackend struct {
+	Backend
+}
+
+func (greetingBackend) Greeting() string {
+	return "200 test"
+}
+
+// dialServer starts a session on a loopback connection and returns client side of it.
+func dialServer(t *testing.T, backend Backend, config *Config) (net.Conn, *bufio.Reader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := NewServer(backend, config)
+	go func() {
+		if nc, err := l.Accept(); err == nil {
+			srv.Handle(nc)
+		}
+	}()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	_ = nc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(nc)
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "200 ") {
+		t.Fatalf("unexpected greeting %q: %v", line, err)
+	}
+
+	return nc, r
+}
+
+func TestUnauthIdleTimeout(t *testing.T) {
+	_, r := dialServer(t, greetingBackend{}, &Config{UnauthIdleTimeout: 50 * time.Millisecond})
+
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "400 ") {
+		t.Fatalf("expected 400 on timeout, got %q: %v", line, err)
+	}
+
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("connection not closed")
+	}
+}
+
+func TestUnauthLifetime(t *testing.T) {
+	nc, r := dialServer(t, greetingBackend{}, &Config{UnauthIdleTimeout: time.Second, UnauthLifetime: 100 * time.Millisecond})
+
+	// commands keep the session busy, but not past its lifetime
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := nc.Write([]byte("FOO\r\n")); err != nil {
+			break
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "400 ") {
+			if time.Since(start) > time.Second {
+				t.Errorf("disconnected after %v", time.Since(start))
+			}
+			return
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	t.Error("session outlived its lifetime")
+}
+
+func TestMaxLineLength(t *testing.T) {
+	nc, r := dialServer(t, greetingBackend{}, &Config{MaxLineLength: 16})
+
+	if _, err := nc.Write([]byte("FOO\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "500 ") {
+		t.Fatalf("expected 500 for unknown command, got %q", line)
+	}
+
+	if _, err := nc.Write([]byte(strings.Repeat("X", 64) + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "400 ") {
+		t.Fatalf("expected 400 for long line, got %q: %v", line, err)
+	}
+}
@@ -0,0 +1,165 @@
+package nntpserver
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lockout describes authentication failures tracked for an ip or user.
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// authGuard tracks failed authentication attempts per ip and per user.
+// Every failure is answered after a delay doubling with each next one,
+// once there were too many failures within window, further attempts
+// are refused till lockout is over.
+type authGuard struct {
+	sync.Mutex
+	config  *Config
+	entries map[string]*Lockout
+	pruned  time.Time
+}
+
+func newAuthGuard(config *Config) *authGuard {
+	return &authGuard{
+		config:  config,
+		entries: make(map[string]*Lockout),
+		pruned:  time.Now(),
+	}
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func userKey(user string) string {
+	return "user:" + user
+}
+
+// Locked tells whether ip or user is locked out.
+func (g *authGuard) Locked(ip string, user string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	for _, key := range []string{ipKey(ip), userKey(user)} {
+		if entry, ok := g.entries[key]; ok && now.Before(entry.LockedUntil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Failure records failed attempt and returns delay to apply before answering.
+func (g *authGuard) Failure(ip string, user string) time.Duration {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	g.prune(now)
+
+	failures := 0
+	for _, key := range []string{ipKey(ip), userKey(user)} {
+		entry, ok := g.entries[key]
+		if !ok || g.stale(entry, now) {
+			entry = &Lockout{Key: key}
+			g.entries[key] = entry
+		}
+
+		entry.Failures++
+		entry.LastFailure = now
+
+		if g.config.AuthMaxFailures > 0 && entry.Failures >= g.config.AuthMaxFailures {
+			entry.LockedUntil = now.Add(g.config.AuthLockout)
+		}
+
+		if entry.Failures > failures {
+			failures = entry.Failures
+		}
+	}
+
+	return g.delay(failures)
+}
+
+// Success forgets failures of user, ip failures are kept as the same
+// ip might be guessing passwords of other users as well.
+func (g *authGuard) Success(user string) {
+	g.Lock()
+	delete(g.entries, userKey(user))
+	g.Unlock()
+}
+
+// Clear forgets failures and lockout of ip or user key.
+func (g *authGuard) Clear(key string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	_, ok := g.entries[key]
+	delete(g.entries, key)
+	return ok
+}
+
+// Lockouts lists tracked ips and users, locked ones first.
+func (g *authGuard) Lockouts() []Lockout {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	lockouts := make([]Lockout, 0, len(g.entries))
+	for _, entry := range g.entries {
+		if !g.stale(entry, now) {
+			lockouts = append(lockouts, *entry)
+		}
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		if !lockouts[i].LockedUntil.Equal(lockouts[j].LockedUntil) {
+			return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil)
+		}
+		return lockouts[i].Key < lockouts[j].Key
+	})
+
+	return lockouts
+}
+
+func (g *authGuard) delay(failures int) time.Duration {
+	if failures == 0 || g.config.AuthDelay == 0 {
+		return 0
+	}
+
+	delay := g.config.AuthDelay
+	for i := 1; i < failures && i < 16; i++ {
+		delay *= 2
+	}
+
+	if g.config.AuthMaxDelay > 0 && delay > g.config.AuthMaxDelay {
+		delay = g.config.AuthMaxDelay
+	}
+
+	return delay
+}
+
+// stale tells whether entry's failures are old enough to be forgotten.
+func (g *authGuard) stale(entry *Lockout, now time.Time) bool {
+	return now.After(entry.LockedUntil) && now.Sub(entry.LastFailure) > g.config.AuthWindow
+}
+
+// prune drops stale entries, at most once per window.
+func (g *authGuard) prune(now time.Time) {
+	if now.Sub(g.pruned) < g.config.AuthWindow {
+		return
+	}
+	g.pruned = now
+
+	for key, entry := range g.entries {
+		if g.stale(entry, now) {
+			delete(g.entries, key)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package nntpserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthGuardLockout(t *testing.T) {
+	g := newAuthGuard(&Config{
+		AuthMaxFailures: 3,
+		AuthWindow:      time.Minute,
+		AuthLockout:     time.Minute,
+		AuthDelay:       100 * time.Millisecond,
+		AuthMaxDelay:    300 * time.Millisecond,
+	})
+
+	delays := []time.Duration{
+		g.Failure("1.1.1.1", "bob"),
+		g.Failure("1.1.1.1", "bob"),
+		g.Failure("1.1.1.1", "bob"),
+	}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	for i := range delays {
+		if delays[i] != expected[i] {
+			t.Errorf("failure %d: expected delay %v, got %v", i+1, expected[i], delays[i])
+		}
+	}
+
+	if !g.Locked("1.1.1.1", "alice") {
+		t.Error("ip not locked")
+	}
+	if !g.Locked("2.2.2.2", "bob") {
+		t.Error("user not locked")
+	}
+	if g.Locked("2.2.2.2", "alice") {
+		t.Error("unrelated ip and user locked")
+	}
+
+	if !g.Clear(userKey("bob")) {
+		t.Error("user lockout not cleared")
+	}
+	if g.Locked("2.2.2.2", "bob") {
+		t.Error("user still locked after clear")
+	}
+	if !g.Locked("1.1.1.1", "bob") {
+		t.Error("ip lockout cleared with user one")
+	}
+}
+
+func TestAuthGuardSuccess(t *testing.T) {
+	g := newAuthGuard(&Config{
+		AuthMaxFailures: 2,
+		AuthWindow:      time.Minute,
+		AuthLockout:     time.Minute,
+	})
+
+	g.Failure("1.1.1.1", "bob")
+	g.Success("bob")
+	g.Failure("2.2.2.2", "bob")
+
+	if g.Locked("3.3.3.3", "bob") {
+		t.Error("failures before success counted")
+	}
+}
+
+func TestAuthGuardWindow(t *testing.T) {
+	g := newAuthGuard(&Config{
+		AuthMaxFailures: 2,
+		AuthWindow:      time.Millisecond,
+		AuthLockout:     time.Minute,
+	})
+
+	g.Failure("1.1.1.1", "bob")
+	time.Sleep(5 * time.Millisecond)
+	g.Failure("1.1.1.1", "bob")
+
+	if g.Locked("1.1.1.1", "bob") {
+		t.Error("failures outside of window counted")
+	}
+	if len(g.Lockouts()) != 2 {
+		t.Errorf("expected ip and user entries, got %v", g.Lockouts())
+	}
+}
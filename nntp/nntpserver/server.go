@@ -1,6 +1,7 @@
 package nntpserver
 
 import (
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
@@ -9,6 +10,8 @@ import (
 	"net"
 	"net/textproto"
 	"nntplexer/metrics"
+	"nntplexer/nntp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,6 +26,12 @@ type Session struct {
 	pass   string
 	authed bool
 	conn   *textproto.Conn
+	nc     net.Conn
+	start  time.Time
+	// selected group and current article number in it,
+	// 0 when there's no current article
+	group   string
+	article int64
 }
 
 func (sess *Session) IsAuthed() bool {
@@ -37,6 +46,23 @@ func (sess *Session) SetAuthed(authed bool) {
 	sess.Unlock()
 }
 
+// selectGroup makes group the selected one, with its first article current.
+func (sess *Session) selectGroup(group nntp.Group) {
+	sess.group = group.Name
+	sess.article = 0
+	if group.Count > 0 {
+		sess.article = group.Low
+	}
+}
+
+// setArticle makes article current, message-id lookups (number 0) leave
+// current article as is.
+func (sess *Session) setArticle(number int64) {
+	if number > 0 {
+		sess.article = number
+	}
+}
+
 // Handler is a low-level protocol handler
 type Handler func(args []string, sess *Session) error
 
@@ -45,22 +71,65 @@ type Backend interface {
 	Greeting() string
 	Authenticate(user string, pass string) bool
 	CheckConnLimit(user string, conns int) bool
-	Article(messageId string) (textproto.MIMEHeader, io.Reader, error)
-	Body(messageId string) (textproto.MIMEHeader, io.Reader, error)
+	CheckQuota(user string) bool
+	Article(messageId string) (textproto.MIMEHeader, io.ReadCloser, error)
+	Body(messageId string) (textproto.MIMEHeader, io.ReadCloser, error)
+	Head(messageId string) (textproto.MIMEHeader, error)
+	Stat(messageId string) error
+	Group(name string) (nntp.Group, error)
+	ListGroup(name string, rng string) (nntp.Group, []int64, error)
+	Next(group string, number int64) (int64, string, error)
+	Last(group string, number int64) (int64, string, error)
+	GroupArticle(group string, number int64) (string, textproto.MIMEHeader, io.ReadCloser, error)
+	GroupBody(group string, number int64) (string, io.ReadCloser, error)
+	GroupHead(group string, number int64) (string, textproto.MIMEHeader, error)
+	GroupStat(group string, number int64) (string, error)
+	Over(group string, rng string) (io.ReadCloser, error)
+	Hdr(group string, field string, rng string) (io.ReadCloser, error)
+	// HasOverview tells whether Over and Hdr can serve article ranges
+	HasOverview() bool
+	List(keyword string) ([]string, error)
 	Stats(user string, rx int64, tx int64)
 	CheckIpLimit(user string, ip string, ips map[string]int) bool
 }
 
+type Config struct {
+	// AuthMaxFailures failed authentications of an ip or user within
+	// AuthWindow lock it out for AuthLockout, 0 disables lockouts
+	AuthMaxFailures int
+	AuthWindow      time.Duration
+	AuthLockout     time.Duration
+	// AuthDelay is applied to a failed authentication, doubling with
+	// every next failure up to AuthMaxDelay
+	AuthDelay    time.Duration
+	AuthMaxDelay time.Duration
+
+	// IdleTimeout disconnects sessions idle between commands,
+	// UnauthIdleTimeout ones not authenticated yet, which are
+	// moreover disconnected UnauthLifetime after connecting
+	IdleTimeout       time.Duration
+	UnauthIdleTimeout time.Duration
+	UnauthLifetime    time.Duration
+	// WriteTimeout disconnects clients too slow to receive a write
+	WriteTimeout time.Duration
+	// MaxLineLength limits command line length, 0 means unlimited
+	MaxLineLength int
+}
+
 type Server struct {
 	sync.RWMutex
 	backend  Backend
+	config   *Config
+	guard    *authGuard
 	handlers map[string]Handler
 	sessions map[string][]*Session
 }
 
-func NewServer(backend Backend) *Server {
+func NewServer(backend Backend, config *Config) *Server {
 	server := Server{
 		backend:  backend,
+		config:   config,
+		guard:    newAuthGuard(config),
 		handlers: make(map[string]Handler),
 		sessions: make(map[string][]*Session),
 	}
@@ -73,9 +142,18 @@ func NewServer(backend Backend) *Server {
 	
 	server.handlers["head"] = server.handleHead
 	server.handlers["group"] = server.handleGroup
+	server.handlers["listgroup"] = server.handleListGroup
+	server.handlers["next"] = server.handleNext
+	server.handlers["last"] = server.handleLast
+	server.handlers["over"] = server.handleOver
+	server.handlers["xover"] = server.handleOver
+	server.handlers["hdr"] = server.handleHdr
+	server.handlers["xhdr"] = server.handleXHdr
 	server.handlers["list"] = server.handleList
 	server.handlers["mode"] = server.handleMode
 	server.handlers["stat"] = server.handleStat
+	server.handlers["date"] = server.handleDate
+	server.handlers["help"] = server.handleHelp
 
 	return &server
 }
@@ -120,12 +198,29 @@ func (srv *Server) handleCapabilities(args []string, sess *Session) error {
 		return err
 	}
 
-	if !sess.IsAuthed() {
-		if _, err := fmt.Fprintln(dw, "AUTHINFO USER PASS"); err != nil {
-			return err
+	capabilities := []string{"AUTHINFO USER"}
+	if sess.IsAuthed() {
+		// overview commands are advertised only when they would work
+		if srv.backend.HasOverview() {
+			capabilities = []string{
+				"READER",
+				"HDR",
+				"OVER",
+				"LIST ACTIVE ACTIVE.TIMES HEADERS NEWSGROUPS OVERVIEW.FMT",
+			}
+		} else {
+			capabilities = []string{
+				"READER",
+				"LIST ACTIVE ACTIVE.TIMES NEWSGROUPS",
+			}
 		}
-	} else {
-		if _, err := fmt.Fprintln(dw, "READER"); err != nil {
+		if srv.posting() {
+			capabilities = append(capabilities, "POST")
+		}
+	}
+
+	for _, capability := range capabilities {
+		if _, err := fmt.Fprintln(dw, capability); err != nil {
 			return err
 		}
 	}
@@ -133,6 +228,12 @@ func (srv *Server) handleCapabilities(args []string, sess *Session) error {
 	return dw.Close()
 }
 
+// posting tells whether clients may post articles.
+func (srv *Server) posting() bool {
+	_, ok := srv.handlers["post"]
+	return ok
+}
+
 func (srv *Server) handleAuth(args []string, sess *Session) error {
 	if sess.IsAuthed() {
 		return &textproto.Error{Code: 502, Msg: "Command unavailable"}
@@ -153,10 +254,21 @@ func (srv *Server) handleAuth(args []string, sess *Session) error {
 
 		sess.pass = args[1]
 
+		if srv.guard.Locked(sess.ip, sess.user) {
+			metrics.AuthFailures.With(prometheus.Labels{"reason": "locked"}).Inc()
+			return &textproto.Error{Code: 502, Msg: "Too many authentication failures, try again later"}
+		}
+
 		if !srv.backend.Authenticate(sess.user, sess.pass) {
+			metrics.AuthFailures.With(prometheus.Labels{"reason": "password"}).Inc()
+			log.Printf("[%s] Authentication of %s from %s failed\n", sess.id, sess.user, sess.ip)
+
+			time.Sleep(srv.guard.Failure(sess.ip, sess.user))
 			return &textproto.Error{Code: 481, Msg: "Authentication failed"}
 		}
 
+		srv.guard.Success(sess.user)
+
 		srv.Lock()
 		defer srv.Unlock()
 
@@ -184,17 +296,29 @@ func (srv *Server) handleArticle(args []string, sess *Session) error {
 		return &textproto.Error{Code: 480, Msg: "Authentication required"}
 	}
 
-	if len(args) < 1 {
-		return &textproto.Error{Code: 501, Msg: "Not enough arguments"}
+	if !srv.backend.CheckQuota(sess.user) {
+		return &textproto.Error{Code: 502, Msg: "Download quota exceeded"}
 	}
 
-	messageId := args[0]
+	messageId, number, err := srv.articleRef(args, sess)
+	if err != nil {
+		return err
+	}
 
-	headers, reader, err := srv.backend.Article(messageId)
+	var headers textproto.MIMEHeader
+	var reader io.ReadCloser
+	if number == 0 {
+		headers, reader, err = srv.backend.Article(messageId)
+	} else {
+		messageId, headers, reader, err = srv.backend.GroupArticle(sess.group, number)
+	}
 	if err != nil {
 		return err
 	}
-	_ = sess.conn.PrintfLine("222 0 " + messageId)
+	defer reader.Close()
+
+	sess.setArticle(number)
+	_ = sess.conn.PrintfLine("220 %d %s", number, messageId)
 
 	for key, values := range headers {
 		for _, value := range values {
@@ -208,15 +332,7 @@ func (srv *Server) handleArticle(args []string, sess *Session) error {
 		_ = sess.conn.PrintfLine("")
 	}
 
-	dw := sess.conn.DotWriter()
-	defer dw.Close()
-
-	bytes, err := io.Copy(dw, reader)
-	if bytes > 0 {
-		go srv.processStats(bytes, sess)
-	}
-
-	return err
+	return srv.copyBody(reader, sess)
 }
 
 func (srv *Server) handleBody(args []string, sess *Session) error {
@@ -224,27 +340,48 @@ func (srv *Server) handleBody(args []string, sess *Session) error {
 		return &textproto.Error{Code: 480, Msg: "Authentication required"}
 	}
 
-	if len(args) < 1 {
-		return &textproto.Error{Code: 501, Msg: "Not enough arguments"}
+	if !srv.backend.CheckQuota(sess.user) {
+		return &textproto.Error{Code: 502, Msg: "Download quota exceeded"}
 	}
 
-	messageId := args[0]
+	messageId, number, err := srv.articleRef(args, sess)
+	if err != nil {
+		return err
+	}
 
-	_, reader, err := srv.backend.Body(messageId)
+	var reader io.ReadCloser
+	if number == 0 {
+		_, reader, err = srv.backend.Body(messageId)
+	} else {
+		messageId, reader, err = srv.backend.GroupBody(sess.group, number)
+	}
 	if err != nil {
 		return err
 	}
-	_ = sess.conn.PrintfLine("222 0 " + messageId)
+	defer reader.Close()
+
+	sess.setArticle(number)
+	_ = sess.conn.PrintfLine("222 %d %s", number, messageId)
 
+	return srv.copyBody(reader, sess)
+}
+
+// copyBody streams article body to the client as a dot terminated block.
+func (srv *Server) copyBody(reader io.Reader, sess *Session) error {
 	dw := sess.conn.DotWriter()
-	defer dw.Close()
 
 	bytes, err := io.Copy(dw, reader)
 	if bytes > 0 {
-		go srv.processStats(bytes, sess)
+		srv.processStats(bytes, sess)
 	}
 
-	return err
+	if err != nil {
+		// status line is already sent, terminating the block would
+		// pass truncated article as a complete one, drop session instead
+		return err
+	}
+
+	return dw.Close()
 }
 
 func (srv *Server) handleQuit(args []string, sess *Session) error {
@@ -257,43 +394,374 @@ func (srv *Server) handleQuit(args []string, sess *Session) error {
 }
 
 func (srv *Server) handleHead(args []string, sess *Session) error {
-	err := sess.conn.PrintfLine("205 Bye!")
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	messageId, number, err := srv.articleRef(args, sess)
 	if err != nil {
 		return err
 	}
-	return io.EOF
+
+	var headers textproto.MIMEHeader
+	if number == 0 {
+		headers, err = srv.backend.Head(messageId)
+	} else {
+		messageId, headers, err = srv.backend.GroupHead(sess.group, number)
+	}
+	if err != nil {
+		return err
+	}
+
+	sess.setArticle(number)
+	_ = sess.conn.PrintfLine("221 %d %s", number, messageId)
+
+	dw := sess.conn.DotWriter()
+
+	for key, values := range headers {
+		for _, value := range values {
+			if _, err := fmt.Fprintf(dw, "%s: %s\n", key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return dw.Close()
 }
 
 func (srv *Server) handleGroup(args []string, sess *Session) error {
-	err := sess.conn.PrintfLine("205 Bye!")
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	if len(args) < 1 {
+		return &textproto.Error{Code: 501, Msg: "Not enough arguments"}
+	}
+
+	group, err := srv.backend.Group(args[0])
 	if err != nil {
 		return err
 	}
-	return io.EOF
+	sess.selectGroup(group)
+
+	return sess.conn.PrintfLine("211 %d %d %d %s", group.Count, group.Low, group.High, group.Name)
 }
 
-func (srv *Server) handleList(args []string, sess *Session) error {
-	err := sess.conn.PrintfLine("205 Bye!")
+func (srv *Server) handleListGroup(args []string, sess *Session) error {
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	name := sess.group
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" {
+		return &textproto.Error{Code: 412, Msg: "No newsgroup selected"}
+	}
+
+	rng := ""
+	if len(args) > 1 {
+		rng = args[1]
+	}
+
+	group, numbers, err := srv.backend.ListGroup(name, rng)
 	if err != nil {
 		return err
 	}
-	return io.EOF
+	sess.selectGroup(group)
+
+	_ = sess.conn.PrintfLine("211 %d %d %d %s list follows", group.Count, group.Low, group.High, group.Name)
+
+	dw := sess.conn.DotWriter()
+	for _, number := range numbers {
+		if _, err := fmt.Fprintf(dw, "%d\n", number); err != nil {
+			return err
+		}
+	}
+
+	return dw.Close()
 }
 
-func (srv *Server) handleMode(args []string, sess *Session) error {
-	err := sess.conn.PrintfLine("205 Bye!")
+func (srv *Server) handleNext(args []string, sess *Session) error {
+	return srv.move(sess, srv.backend.Next)
+}
+
+func (srv *Server) handleLast(args []string, sess *Session) error {
+	return srv.move(sess, srv.backend.Last)
+}
+
+// move moves current article pointer with step and reports where it points.
+func (srv *Server) move(sess *Session, step func(group string, number int64) (int64, string, error)) error {
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	if sess.group == "" {
+		return &textproto.Error{Code: 412, Msg: "No newsgroup selected"}
+	}
+	if sess.article == 0 {
+		return &textproto.Error{Code: 420, Msg: "Current article number is invalid"}
+	}
+
+	number, messageId, err := step(sess.group, sess.article)
 	if err != nil {
 		return err
 	}
-	return io.EOF
+	sess.setArticle(number)
+
+	return sess.conn.PrintfLine("223 %d %s", number, messageId)
+}
+
+func (srv *Server) handleOver(args []string, sess *Session) error {
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	rng, err := srv.overviewRange(args, sess)
+	if err != nil {
+		return err
+	}
+
+	reader, err := srv.backend.Over(sess.group, rng)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_ = sess.conn.PrintfLine("224 Overview information follows")
+
+	return srv.copyBody(reader, sess)
+}
+
+func (srv *Server) handleHdr(args []string, sess *Session) error {
+	return srv.hdr(args, sess, 225)
+}
+
+// handleXHdr serves XHDR, which differs from HDR in response code only.
+func (srv *Server) handleXHdr(args []string, sess *Session) error {
+	return srv.hdr(args, sess, 221)
+}
+
+func (srv *Server) hdr(args []string, sess *Session, code int) error {
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	if len(args) < 1 {
+		return &textproto.Error{Code: 501, Msg: "Not enough arguments"}
+	}
+
+	rng, err := srv.overviewRange(args[1:], sess)
+	if err != nil {
+		return err
+	}
+
+	reader, err := srv.backend.Hdr(sess.group, args[0], rng)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_ = sess.conn.PrintfLine("%d Headers follow", code)
+
+	return srv.copyBody(reader, sess)
+}
+
+// overviewRange resolves argument of OVER and HDR, which is either
+// a message-id or an article range ("n", "n-" or "n-m") in the selected
+// group, current article is used without argument.
+func (srv *Server) overviewRange(args []string, sess *Session) (string, error) {
+	if len(args) > 0 && strings.HasPrefix(args[0], "<") {
+		return args[0], nil
+	}
+
+	if sess.group == "" {
+		return "", &textproto.Error{Code: 412, Msg: "No newsgroup selected"}
+	}
+
+	if len(args) == 0 {
+		if sess.article == 0 {
+			return "", &textproto.Error{Code: 420, Msg: "Current article number is invalid"}
+		}
+		return strconv.FormatInt(sess.article, 10), nil
+	}
+
+	low, high := args[0], ""
+	if i := strings.IndexByte(args[0], '-'); i >= 0 {
+		low, high = args[0][:i], args[0][i+1:]
+	}
+	if _, err := strconv.ParseUint(low, 10, 64); err != nil {
+		return "", &textproto.Error{Code: 501, Msg: "Syntax error"}
+	}
+	if _, err := strconv.ParseUint(high, 10, 64); high != "" && err != nil {
+		return "", &textproto.Error{Code: 501, Msg: "Syntax error"}
+	}
+
+	return args[0], nil
+}
+
+// articleRef resolves argument of ARTICLE, BODY, HEAD and STAT, which is
+// either a message-id or an article number in the selected group, current
+// article is used without argument. Number is 0 for message-ids.
+func (srv *Server) articleRef(args []string, sess *Session) (string, int64, error) {
+	if len(args) > 0 && strings.HasPrefix(args[0], "<") {
+		return args[0], 0, nil
+	}
+
+	if len(args) > 0 {
+		number, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || number <= 0 {
+			return "", 0, &textproto.Error{Code: 501, Msg: "Syntax error"}
+		}
+		if sess.group == "" {
+			return "", 0, &textproto.Error{Code: 412, Msg: "No newsgroup selected"}
+		}
+		return "", number, nil
+	}
+
+	if sess.group == "" {
+		return "", 0, &textproto.Error{Code: 412, Msg: "No newsgroup selected"}
+	}
+	if sess.article == 0 {
+		return "", 0, &textproto.Error{Code: 420, Msg: "Current article number is invalid"}
+	}
+
+	return "", sess.article, nil
+}
+
+func (srv *Server) handleList(args []string, sess *Session) error {
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	keyword := "active"
+	if len(args) > 0 {
+		keyword = strings.ToLower(args[0])
+	}
+
+	var pattern wildmat
+	switch keyword {
+	case "active", "active.times", "newsgroups":
+		if len(args) > 1 {
+			pattern = parseWildmat(args[1])
+		}
+	case "overview.fmt":
+		if len(args) > 1 {
+			return &textproto.Error{Code: 501, Msg: "Syntax error"}
+		}
+	case "headers":
+		// fields HDR can serve for message-ids or ranges, or both
+		if len(args) > 1 {
+			variant := strings.ToLower(args[1])
+			if variant != "msgid" && variant != "range" {
+				return &textproto.Error{Code: 501, Msg: "Syntax error"}
+			}
+			keyword += " " + variant
+		}
+	default:
+		return &textproto.Error{Code: 501, Msg: "Unknown LIST keyword " + args[0]}
+	}
+
+	lines, err := srv.backend.List(keyword)
+	if err != nil {
+		return err
+	}
+
+	_ = sess.conn.PrintfLine("215 Information follows")
+
+	dw := sess.conn.DotWriter()
+	for _, line := range lines {
+		// lines of group lists start with group name
+		name := line
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name = line[:i]
+		}
+		if pattern != nil && !pattern.Match(name) {
+			continue
+		}
+		if _, err := fmt.Fprintln(dw, line); err != nil {
+			return err
+		}
+	}
+
+	return dw.Close()
+}
+
+// handleMode acknowledges MODE READER, the server is always in reader mode.
+func (srv *Server) handleMode(args []string, sess *Session) error {
+	if len(args) < 1 || !strings.EqualFold(args[0], "reader") {
+		return &textproto.Error{Code: 501, Msg: "Unknown MODE variant"}
+	}
+
+	if srv.posting() {
+		return sess.conn.PrintfLine("200 Posting allowed")
+	}
+	return sess.conn.PrintfLine("201 Posting prohibited")
+}
+
+func (srv *Server) handleDate(args []string, sess *Session) error {
+	return sess.conn.PrintfLine("111 %s", time.Now().UTC().Format("20060102150405"))
+}
+
+// handleHelp lists commands the server knows.
+func (srv *Server) handleHelp(args []string, sess *Session) error {
+	commands := make([]string, 0, len(srv.handlers))
+	for command := range srv.handlers {
+		commands = append(commands, strings.ToUpper(command))
+	}
+	sort.Strings(commands)
+
+	_ = sess.conn.PrintfLine("100 Help text follows")
+
+	dw := sess.conn.DotWriter()
+	for _, command := range commands {
+		if _, err := fmt.Fprintln(dw, command); err != nil {
+			return err
+		}
+	}
+
+	return dw.Close()
 }
 
 func (srv *Server) handleStat(args []string, sess *Session) error {
-	err := sess.conn.PrintfLine("205 Bye!")
+	if !sess.IsAuthed() {
+		return &textproto.Error{Code: 480, Msg: "Authentication required"}
+	}
+
+	messageId, number, err := srv.articleRef(args, sess)
 	if err != nil {
 		return err
 	}
-	return io.EOF
+
+	if number == 0 {
+		err = srv.backend.Stat(messageId)
+	} else {
+		messageId, err = srv.backend.GroupStat(sess.group, number)
+	}
+	if err != nil {
+		return err
+	}
+
+	sess.setArticle(number)
+	return sess.conn.PrintfLine("223 %d %s", number, messageId)
+}
+
+// Lockouts lists ips and users with recent authentication failures.
+func (srv *Server) Lockouts() []Lockout {
+	return srv.guard.Lockouts()
+}
+
+// ClearLockout forgets authentication failures of ip or user.
+func (srv *Server) ClearLockout(ip string, user string) bool {
+	cleared := false
+	if ip != "" {
+		cleared = srv.guard.Clear(ipKey(ip)) || cleared
+	}
+	if user != "" {
+		cleared = srv.guard.Clear(userKey(user)) || cleared
+	}
+	return cleared
 }
 
 func (srv *Server) Serve(listener net.Listener) error {
@@ -330,13 +798,21 @@ func (srv *Server) Handle(nc net.Conn) {
 		return
 	}
 
-	c := textproto.NewConn(nc)
+	sc := &sessionConn{
+		Conn:         nc,
+		writeTimeout: srv.config.WriteTimeout,
+		maxLine:      srv.config.MaxLineLength,
+	}
+
+	c := textproto.NewConn(sc)
 	defer c.Close()
 
 	sess := &Session{
-		id:   uuid.NewString(),
-		ip:   ip,
-		conn: c,
+		id:    uuid.NewString(),
+		ip:    ip,
+		conn:  c,
+		nc:    sc,
+		start: time.Now(),
 	}
 
 	// deauth session
@@ -348,17 +824,34 @@ func (srv *Server) Handle(nc net.Conn) {
 		}
 	}()
 
+	reason := "error"
+	defer func() {
+		metrics.ServerDisconnects.With(prometheus.Labels{"reason": reason}).Inc()
+	}()
+
 	log.Printf("[%s] Connection from %s accepted\n", sess.id, sess.ip)
 
 	if err := c.PrintfLine(srv.backend.Greeting()); err != nil {
+		reason = srv.disconnectReason(err, sess)
 		log.Println(err)
 		return
 	}
 
 	for {
+		if err := srv.setReadDeadline(sess); err != nil {
+			log.Println(err)
+			return
+		}
+
 		line, err := c.ReadLine()
+		if sc.tooLong {
+			// whatever was buffered before the overlong line is dropped too
+			err = errLineTooLong
+		}
 		if err != nil {
-			log.Println(err)
+			reason = srv.disconnectReason(err, sess)
+			srv.sayGoodbye(reason, sess)
+			log.Printf("[%s] Disconnected: %v\n", sess.id, err)
 			return
 		}
 		if line == "" {
@@ -372,6 +865,7 @@ func (srv *Server) Handle(nc net.Conn) {
 
 				log.Printf("[%s] -> Protocol error: %v\n", sess.id, txterr)
 				if err := c.PrintfLine("%d %s", txterr.Code, txterr.Msg); err != nil {
+					reason = srv.disconnectReason(err, sess)
 					log.Println(err)
 					return
 				}
@@ -380,8 +874,10 @@ func (srv *Server) Handle(nc net.Conn) {
 
 			switch err {
 			case io.EOF:
+				reason = "quit"
 				return
 			default:
+				reason = srv.disconnectReason(err, sess)
 				log.Print(err)
 				return
 			}
@@ -390,6 +886,66 @@ func (srv *Server) Handle(nc net.Conn) {
 	}
 }
 
+// setReadDeadline limits how long the next command is waited for.
+func (srv *Server) setReadDeadline(sess *Session) error {
+	timeout := srv.config.IdleTimeout
+
+	if !sess.IsAuthed() {
+		timeout = srv.config.UnauthIdleTimeout
+
+		if srv.config.UnauthLifetime > 0 {
+			left := srv.config.UnauthLifetime - time.Since(sess.start)
+			if left <= 0 {
+				// a deadline in the past fails the read right away
+				left = time.Nanosecond
+			}
+			if timeout == 0 || left < timeout {
+				timeout = left
+			}
+		}
+	}
+
+	if timeout == 0 {
+		return sess.nc.SetReadDeadline(time.Time{})
+	}
+	return sess.nc.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// disconnectReason classifies error the session ended with.
+func (srv *Server) disconnectReason(err error, sess *Session) string {
+	switch {
+	case err == io.EOF:
+		return "closed"
+	case err == errLineTooLong:
+		return "line_too_long"
+	case isTimeout(err):
+		var ne *net.OpError
+		if errors.As(err, &ne) && ne.Op == "write" {
+			return "write_timeout"
+		}
+		if !sess.IsAuthed() {
+			return "unauth_timeout"
+		}
+		return "idle_timeout"
+	}
+	return "error"
+}
+
+// sayGoodbye tells client why it's being disconnected, when it's still listening.
+func (srv *Server) sayGoodbye(reason string, sess *Session) {
+	var msg string
+	switch reason {
+	case "idle_timeout", "unauth_timeout":
+		msg = "400 Idle timeout, closing connection"
+	case "line_too_long":
+		msg = "400 Command line too long, closing connection"
+	default:
+		return
+	}
+
+	_ = sess.conn.PrintfLine(msg)
+}
+
 func (srv *Server) dispatch(cmd string, args []string, sess *Session) error {
 	if cmd != "BODY" {
 		log.Printf("[%s] <- Command: %s, Arguments: %s\n", sess.id, cmd, args)
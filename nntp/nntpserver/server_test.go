@@ -0,0 +1,293 @@
+package nntpserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"nntplexer/nntp"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// groupBackend serves a single group holding articles 3 to 5.
+type groupBackend struct {
+	greetingBackend
+}
+
+func (groupBackend) Authenticate(user string, pass string) bool            { return true }
+func (groupBackend) CheckConnLimit(user string, conns int) bool            { return true }
+func (groupBackend) CheckIpLimit(user, ip string, ips map[string]int) bool { return true }
+func (groupBackend) Stats(user string, rx int64, tx int64)                 {}
+
+func (groupBackend) Group(name string) (nntp.Group, error) {
+	if name != "misc.test" {
+		return nntp.Group{}, &textproto.Error{Code: 411, Msg: "No such newsgroup"}
+	}
+	return nntp.Group{Name: name, Count: 3, Low: 3, High: 5}, nil
+}
+
+func (groupBackend) Next(group string, number int64) (int64, string, error) {
+	if number >= 5 {
+		return 0, "", &textproto.Error{Code: 421, Msg: "No next article in this group"}
+	}
+	return number + 1, fmt.Sprintf("<%d@test>", number+1), nil
+}
+
+func (groupBackend) GroupStat(group string, number int64) (string, error) {
+	if number < 3 || number > 5 {
+		return "", &textproto.Error{Code: 423, Msg: "No article with that number"}
+	}
+	return fmt.Sprintf("<%d@test>", number), nil
+}
+
+func (groupBackend) Stat(messageId string) error {
+	return nil
+}
+
+func (groupBackend) List(keyword string) ([]string, error) {
+	if keyword != "active" {
+		return nil, &textproto.Error{Code: 503, Msg: "Data item not stored"}
+	}
+	return []string{"misc.test 5 3 y", "misc.other 0 1 n", "alt.test 9 7 m"}, nil
+}
+
+func (groupBackend) HasOverview() bool { return true }
+
+func (groupBackend) Over(group string, rng string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("3\tsubject\n.dotted\n")), nil
+}
+
+// login starts an authenticated session.
+func login(t *testing.T, backend Backend) (net.Conn, *bufio.Reader) {
+	nc, r := dialServer(t, backend, &Config{})
+
+	command(t, nc, r, "AUTHINFO USER u")
+	if status := command(t, nc, r, "AUTHINFO PASS p"); !strings.HasPrefix(status, "281 ") {
+		t.Fatalf("authentication failed: %s", status)
+	}
+
+	return nc, r
+}
+
+// command sends line and returns the status line of response.
+func command(t *testing.T, nc net.Conn, r *bufio.Reader, line string) string {
+	t.Helper()
+
+	if _, err := nc.Write([]byte(line + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimRight(status, "\r\n")
+}
+
+func TestGroupNavigation(t *testing.T) {
+	nc, r := login(t, groupBackend{})
+
+	steps := []struct {
+		line   string
+		status string
+	}{
+		{"STAT", "412 "},
+		{"STAT 3", "412 "},
+		{"STAT <a@b>", "223 0 <a@b>"},
+		{"NEXT", "412 "},
+		{"GROUP alt.none", "411 "},
+		{"GROUP misc.test", "211 3 3 5 misc.test"},
+		{"STAT", "223 3 <3@test>"},
+		{"NEXT", "223 4 <4@test>"},
+		{"STAT", "223 4 <4@test>"},
+		{"STAT 9", "423 "},
+		{"STAT 5", "223 5 <5@test>"},
+		{"NEXT", "421 "},
+		// message-id lookups leave current article alone
+		{"STAT <a@b>", "223 0 <a@b>"},
+		{"STAT", "223 5 <5@test>"},
+		{"STAT x", "501 "},
+	}
+
+	for _, step := range steps {
+		if status := command(t, nc, r, step.line); !strings.HasPrefix(status, step.status) {
+			t.Errorf("%s: expected %q, got %q", step.line, step.status, status)
+		}
+	}
+}
+
+func TestOver(t *testing.T) {
+	nc, r := login(t, groupBackend{})
+
+	for _, step := range []struct {
+		line   string
+		status string
+	}{
+		{"OVER", "412 "},
+		{"OVER 3-", "412 "},
+		{"GROUP misc.test", "211 "},
+		{"OVER x-5", "501 "},
+		{"OVER 3-x", "501 "},
+	} {
+		if status := command(t, nc, r, step.line); !strings.HasPrefix(status, step.status) {
+			t.Errorf("%s: expected %q, got %q", step.line, step.status, status)
+		}
+	}
+
+	if status := command(t, nc, r, "XOVER 3-"); !strings.HasPrefix(status, "224 ") {
+		t.Fatalf("expected overview, got %q", status)
+	}
+	if overview := lines(t, r); len(overview) != 2 || overview[0] != "3\tsubject" || overview[1] != "..dotted" {
+		t.Errorf("unexpected overview %q", overview)
+	}
+}
+
+// lines reads lines of a multi-line response.
+func lines(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ".\r\n" {
+			return lines
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func TestList(t *testing.T) {
+	nc, r := login(t, groupBackend{})
+
+	for _, c := range []struct {
+		line   string
+		groups []string
+	}{
+		{"LIST", []string{"misc.test", "misc.other", "alt.test"}},
+		{"LIST ACTIVE misc.*", []string{"misc.test", "misc.other"}},
+		{"list active *.test,!alt.*", []string{"misc.test"}},
+	} {
+		if status := command(t, nc, r, c.line); !strings.HasPrefix(status, "215 ") {
+			t.Fatalf("%s: expected list, got %q", c.line, status)
+		}
+		listed := lines(t, r)
+		if len(listed) != len(c.groups) {
+			t.Fatalf("%s: expected %v, got %q", c.line, c.groups, listed)
+		}
+		for i, group := range c.groups {
+			if !strings.HasPrefix(listed[i], group+" ") {
+				t.Errorf("%s: expected %v, got %q", c.line, c.groups, listed)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		line   string
+		status string
+	}{
+		{"LIST NEWSGROUPS", "503 "},
+		{"LIST OVERVIEW.FMT x", "501 "},
+		{"LIST FOO", "501 "},
+	} {
+		if status := command(t, nc, r, c.line); !strings.HasPrefix(status, c.status) {
+			t.Errorf("%s: expected %q, got %q", c.line, c.status, status)
+		}
+	}
+}
+
+func TestSessionCommands(t *testing.T) {
+	nc, r := dialServer(t, groupBackend{}, &Config{})
+
+	// available before authentication
+	if status := command(t, nc, r, "MODE READER"); status != "201 Posting prohibited" {
+		t.Errorf("unexpected MODE READER response %q", status)
+	}
+	if status := command(t, nc, r, "MODE STREAM"); !strings.HasPrefix(status, "501 ") {
+		t.Errorf("expected 501 for MODE STREAM, got %q", status)
+	}
+	if status := command(t, nc, r, "DATE"); len(status) != 18 || !strings.HasPrefix(status, "111 20") {
+		t.Errorf("unexpected DATE response %q", status)
+	}
+
+	if status := command(t, nc, r, "HELP"); !strings.HasPrefix(status, "100 ") {
+		t.Fatalf("expected help, got %q", status)
+	}
+	help := strings.Join(lines(t, r), " ")
+	for _, cmd := range []string{"ARTICLE", "DATE", "HELP", "LISTGROUP", "MODE", "XOVER"} {
+		if !strings.Contains(help, cmd) {
+			t.Errorf("%s missing in help %q", cmd, help)
+		}
+	}
+
+	command(t, nc, r, "CAPABILITIES")
+	if caps := lines(t, r); len(caps) != 2 || caps[1] != "AUTHINFO USER" {
+		t.Errorf("unexpected capabilities before authentication %q", caps)
+	}
+
+	command(t, nc, r, "AUTHINFO USER u")
+	command(t, nc, r, "AUTHINFO PASS p")
+
+	command(t, nc, r, "CAPABILITIES")
+	caps := strings.Join(lines(t, r), "\n")
+	if strings.Contains(caps, "AUTHINFO") || !strings.Contains(caps, "READER") || !strings.Contains(caps, "OVER") {
+		t.Errorf("unexpected capabilities after authentication %q", caps)
+	}
+}
+
+// plainBackend has no overview data.
+type plainBackend struct {
+	groupBackend
+}
+
+func (plainBackend) HasOverview() bool { return false }
+
+func TestCapabilitiesWithoutOverview(t *testing.T) {
+	nc, r := login(t, plainBackend{})
+
+	command(t, nc, r, "CAPABILITIES")
+	caps := strings.Join(lines(t, r), "\n")
+	if !strings.Contains(caps, "READER") || strings.Contains(caps, "OVER") || strings.Contains(caps, "HDR") || strings.Contains(caps, "HEADERS") {
+		t.Errorf("unexpected capabilities without overview %q", caps)
+	}
+}
+
+// cutBackend serves bodies which break off half way.
+type cutBackend struct {
+	groupBackend
+}
+
+func (cutBackend) CheckQuota(user string) bool { return true }
+
+func (cutBackend) Body(messageId string) (textproto.MIMEHeader, io.ReadCloser, error) {
+	body := io.MultiReader(strings.NewReader("first\r\n"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	return nil, ioutil.NopCloser(body), nil
+}
+
+func TestBodyCut(t *testing.T) {
+	nc, r := login(t, cutBackend{})
+
+	if status := command(t, nc, r, "BODY <a@b>"); !strings.HasPrefix(status, "222 ") {
+		t.Fatalf("expected body, got %q", status)
+	}
+
+	// truncated body must not look complete, session is dropped instead
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("expected session dropped, got: %v", err)
+		}
+		if line == ".\r\n" {
+			t.Fatal("truncated body terminated as complete")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package nntpserver
+
+import "strings"
+
+// wildmat is a parsed wildmat (RFC 3977, section 4): comma separated
+// patterns of which the rightmost matching one decides, names matching
+// a pattern prefixed with "!" are rejected. Within a pattern "*" matches
+// any sequence of characters and "?" a single character.
+type wildmat []wildmatItem
+
+type wildmatItem struct {
+	pattern []rune
+	negated bool
+}
+
+func parseWildmat(wm string) wildmat {
+	var w wildmat
+	for _, pattern := range strings.Split(wm, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		w = append(w, wildmatItem{pattern: []rune(pattern), negated: negated})
+	}
+
+	return w
+}
+
+// Match tells whether name matches wildmat.
+func (w wildmat) Match(name string) bool {
+	runes := []rune(name)
+	for i := len(w) - 1; i >= 0; i-- {
+		if match(w[i].pattern, runes) {
+			return !w[i].negated
+		}
+	}
+
+	return false
+}
+
+// match matches name against a single wildmat pattern. On a mismatch only
+// the last "*" seen is backtracked to, as letting it eat one more character
+// covers whatever earlier stars could have eaten, so matching takes at most
+// len(pattern)*len(name) steps.
+func match(pattern []rune, name []rune) bool {
+	p, n := 0, 0
+	star, mark := -1, 0
+
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, n
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case star >= 0:
+			mark++
+			p, n = star+1, mark
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
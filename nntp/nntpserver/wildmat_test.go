@@ -0,0 +1,55 @@
+package nntpserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWildmat(t *testing.T) {
+	for _, c := range []struct {
+		wildmat string
+		name    string
+		match   bool
+	}{
+		{"*", "misc.test", true},
+		{"misc.test", "misc.test", true},
+		{"misc.test", "misc.tests", false},
+		{"misc.*", "misc.test", true},
+		{"misc.*", "alt.misc", false},
+		{"misc.tes?", "misc.test", true},
+		{"misc.tes?", "misc.tes", false},
+		{"a*b*c", "abxbc", true},
+		{"a*b*c", "abxbcd", false},
+		{"*,!misc.*", "misc.test", false},
+		{"*,!misc.*", "alt.test", true},
+		// rightmost matching pattern decides
+		{"!misc.*,misc.test", "misc.test", true},
+		{"!misc.*", "alt.test", false},
+		{"??", "äö", true},
+		{"*", "", true},
+		{"", "", true},
+		{"", "a", false},
+		{"a*", "a", true},
+		{"*a*a", "aaa", true},
+	} {
+		if match := parseWildmat(c.wildmat).Match(c.name); match != c.match {
+			t.Errorf("wildmat(%q, %q) = %v, expected %v", c.wildmat, c.name, match, c.match)
+		}
+	}
+}
+
+func TestWildmatPathological(t *testing.T) {
+	w := parseWildmat(strings.Repeat("*?", 12) + "x")
+	name := strings.Repeat("a", 200)
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		if w.Match(name) {
+			t.Fatal("unexpected match")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("matching took %v", elapsed)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/hashicorp/memberlist"
 	"github.com/pires/go-proxyproto"
@@ -12,11 +14,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"nntplexer/metrics"
 	"nntplexer/nntp/nntpserver"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -26,23 +30,77 @@ type Config struct {
 	DbConfig         `ini:"db"`
 	MonitoringConfig `ini:"monitoring"`
 	ClusterConfig    `ini:"cluster"`
+	RouterConfig     `ini:"router"`
+	CacheConfig      `ini:"cache"`
+	S3CacheConfig    `ini:"s3_cache"`
 }
 
 type ServerConfig struct {
 	Addr          string
 	Port          int
 	ProxyProtocol bool
+	Node          uint32
+
+	AuthMaxFailures int
+	AuthWindow      int
+	AuthLockout     int
+	AuthDelay       int
+	AuthMaxDelay    int
+
+	IdleTimeout       int
+	UnauthIdleTimeout int
+	UnauthLifetime    int
+	WriteTimeout      int
+	MaxLineLength     int
 }
 
 type DbConfig struct {
-	Dsn      string
-	CacheTtl int
+	Dsn           string
+	CacheTtl      int
+	FlushInterval int
+	DateCacheSize int
 }
 
 type MonitoringConfig struct {
-	Addr     string
-	Port     int
-	Endpoint string
+	Addr       string
+	Port       int
+	Endpoint   string
+	AdminToken string
+}
+
+type RouterConfig struct {
+	HeadLookup       bool
+	MissingCacheTtl  int
+	MissingCacheSize int
+	Retries          int
+	Balance          string
+	BalanceWindow    int
+	HedgeDelay       int
+	HedgePercentile  float64
+	HedgeMax         int
+	Primary          string
+	ListRefresh      int
+}
+
+type CacheConfig struct {
+	Dirs    []string
+	ShardBy string
+	MaxSize int64
+	Ttl     int
+}
+
+type S3CacheConfig struct {
+	Endpoint      string
+	Region        string
+	Bucket        string
+	Prefix        string
+	AccessKey     string
+	SecretKey     string
+	Ttl           int
+	Timeout       int
+	UploadQueue   int
+	UploadMemory  int64
+	UploadWorkers int
 }
 
 type ClusterConfig struct {
@@ -59,11 +117,11 @@ var Version = "v0.0.3"
 func main() {
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	var config = flag.String("config", "nntplexer.ini", "path to *.ini config file")
+	var passwd = flag.String("passwd", "", "set password of `user` read from stdin and exit")
 
 	flag.Parse()
 
 	log.Printf("nntplexer %s is starting...\n", Version)
-	go handleSignals()
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -79,6 +137,11 @@ func main() {
 
 	cfg := readConfig(*config)
 
+	if *passwd != "" {
+		setPassword(&cfg.DbConfig, *passwd)
+		return
+	}
+
 	listener := initListener(&cfg.ServerConfig)
 	defer listener.Close()
 
@@ -88,26 +151,102 @@ func main() {
 	go initCluster(&cfg.ClusterConfig)
 
 	ur := &UserRepository{db: db}
-	br := &BackendRepository{db: db}
+	br := &BackendRepository{db: db, node: cfg.ServerConfig.Node}
+	metrics.Node.Set(float64(cfg.ServerConfig.Node))
 	ar := &ArticleRepository{db: db}
+	rr := &RuleRepository{db: db}
 	pp := NewPoolProvider()
+	ua := NewAccounting(ur, br)
+	ad := NewArticleDates(ar, cfg.DbConfig.DateCacheSize)
+
+	// traffic and dates not flushed yet are written on shutdown
+	go handleSignals(ua.Flush, ad.Flush)
 
 	schedule(func() {
-		ur.Refresh()
+		ua.Refresh(ur.Refresh)
 		br.Refresh()
+		rr.Refresh()
+		pp.Sync(br.Get())
+	}, 5*time.Second)
+
+	schedule(func() {
+		ua.Flush()
+		ad.Flush()
+	}, time.Duration(cfg.DbConfig.FlushInterval)*time.Second)
+
+	// dialing backends may take a while, keep it off the startup path
+	go schedule(func() {
+		pp.Maintain(br.Get())
 	}, 5*time.Second)
 
 	schedule(func() {
 		ar.Cleanup(cfg.DbConfig.CacheTtl)
+		ur.ResetPeriods(time.Now())
 	}, 1*time.Minute)
 
-	server := nntpserver.NewServer(&NNTPBackend{
+	backend := &NNTPBackend{
 		ur: ur,
 		br: br,
-		ar: ar,
+		ad: ad,
 		pp: pp,
+		rt: &Router{
+			rr:    rr,
+			stats: NewBackendStats(time.Duration(cfg.RouterConfig.BalanceWindow) * time.Second),
+			mode:  cfg.RouterConfig.Balance,
+		},
+		ua: ua,
+		pc: NewPasswordCache(),
+		mc: NewMissingCache(time.Duration(cfg.RouterConfig.MissingCacheTtl)*time.Second, cfg.RouterConfig.MissingCacheSize),
+		lc: NewListCache(),
+
+		headLookup: cfg.RouterConfig.HeadLookup,
+		retries:    cfg.RouterConfig.Retries,
+
+		hedgeDelay:      time.Duration(cfg.RouterConfig.HedgeDelay) * time.Millisecond,
+		hedgePercentile: cfg.RouterConfig.HedgePercentile,
+		hedgeMax:        cfg.RouterConfig.HedgeMax,
+
+		primary: cfg.RouterConfig.Primary,
+	}
+
+	if cfg.RouterConfig.ListRefresh > 0 {
+		go schedule(backend.RefreshLists, time.Duration(cfg.RouterConfig.ListRefresh)*time.Second)
+	}
+
+	var tiers []ArticleCache
+
+	if len(cfg.CacheConfig.Dirs) > 0 {
+		sc := initCache(&cfg.CacheConfig)
+		tiers = append(tiers, sc)
+
+		schedule(sc.Check, 10*time.Second)
+		schedule(sc.Cleanup, 1*time.Minute)
+	}
+
+	if cfg.S3CacheConfig.Endpoint != "" {
+		tiers = append(tiers, initS3Cache(&cfg.S3CacheConfig))
+	}
+
+	if len(tiers) > 0 {
+		backend.ac = NewTieredCache(tiers...)
+	}
+
+	server := nntpserver.NewServer(backend, &nntpserver.Config{
+		AuthMaxFailures: cfg.ServerConfig.AuthMaxFailures,
+		AuthWindow:      time.Duration(cfg.ServerConfig.AuthWindow) * time.Second,
+		AuthLockout:     time.Duration(cfg.ServerConfig.AuthLockout) * time.Second,
+		AuthDelay:       time.Duration(cfg.ServerConfig.AuthDelay) * time.Millisecond,
+		AuthMaxDelay:    time.Duration(cfg.ServerConfig.AuthMaxDelay) * time.Millisecond,
+
+		IdleTimeout:       time.Duration(cfg.ServerConfig.IdleTimeout) * time.Second,
+		UnauthIdleTimeout: time.Duration(cfg.ServerConfig.UnauthIdleTimeout) * time.Second,
+		UnauthLifetime:    time.Duration(cfg.ServerConfig.UnauthLifetime) * time.Second,
+		WriteTimeout:      time.Duration(cfg.ServerConfig.WriteTimeout) * time.Second,
+		MaxLineLength:     cfg.ServerConfig.MaxLineLength,
 	})
 
+	initAdmin(&cfg.MonitoringConfig, server, br)
+
 	log.Println(server.Serve(listener))
 }
 
@@ -131,6 +270,51 @@ func initListener(config *ServerConfig) net.Listener {
 	return listener
 }
 
+func initCache(config *CacheConfig) *ShardedCache {
+	if config.ShardBy != ShardByHash && config.ShardBy != ShardByDate {
+		log.Fatalf("[cache] unknown shard_by: %s\n", config.ShardBy)
+	}
+
+	disks := make([]*DiskCache, 0, len(config.Dirs))
+	for _, dir := range config.Dirs {
+		dc, err := NewDiskCache(
+			dir,
+			config.MaxSize*1024*1024,
+			time.Duration(config.Ttl)*time.Hour,
+		)
+		if err != nil {
+			log.Fatalf("[cache] init failed: %v\n", err)
+		}
+		disks = append(disks, dc)
+	}
+
+	return NewShardedCache(disks, config.ShardBy)
+}
+
+func initS3Cache(config *S3CacheConfig) *S3Cache {
+	if config.Bucket == "" {
+		log.Fatalln("[s3] init failed: bucket is required")
+	}
+
+	log.Printf("[s3] caching articles in %s/%s\n", config.Endpoint, config.Bucket)
+
+	return NewS3Cache(
+		S3Config{
+			Endpoint:  config.Endpoint,
+			Region:    config.Region,
+			Bucket:    config.Bucket,
+			Prefix:    config.Prefix,
+			AccessKey: config.AccessKey,
+			SecretKey: config.SecretKey,
+		},
+		time.Duration(config.Ttl)*time.Hour,
+		time.Duration(config.Timeout)*time.Millisecond,
+		config.UploadQueue,
+		config.UploadMemory*1024*1024,
+		config.UploadWorkers,
+	)
+}
+
 func initMonitoring(monitoringConfig *MonitoringConfig) {
 	addr := net.JoinHostPort(monitoringConfig.Addr, strconv.Itoa(monitoringConfig.Port))
 	log.Printf("[monitoring] starting server on: %s\n", addr)
@@ -176,7 +360,7 @@ func initCluster(clusterConfig *ClusterConfig) {
 	}
 }
 
-func handleSignals() {
+func handleSignals(shutdown ...func()) {
 	sigchan := make(chan os.Signal, 1)
 
 	signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
@@ -191,6 +375,10 @@ func handleSignals() {
 	log.Printf("Signal caught: %s\n", sig)
 	log.Printf("Shutting down...\n")
 
+	for _, what := range shutdown {
+		what()
+	}
+
 	pprof.StopCPUProfile()
 
 	os.Exit(1)
@@ -208,10 +396,17 @@ func schedule(what func(), delay time.Duration) {
 
 func readConfig(path string) *Config {
 	config := &Config{
-		ServerConfig{Addr: "127.0.0.1", Port: 9999, ProxyProtocol: false},
-		DbConfig{},
+		ServerConfig{
+			Addr: "127.0.0.1", Port: 9999, ProxyProtocol: false, Node: 2,
+			AuthMaxFailures: 10, AuthWindow: 600, AuthLockout: 900, AuthDelay: 500, AuthMaxDelay: 8000,
+			IdleTimeout: 300, UnauthIdleTimeout: 30, UnauthLifetime: 60, WriteTimeout: 60, MaxLineLength: 2048,
+		},
+		DbConfig{FlushInterval: 10, DateCacheSize: 100000},
 		MonitoringConfig{},
 		ClusterConfig{},
+		RouterConfig{MissingCacheTtl: 600, MissingCacheSize: 100000, Retries: 1, Balance: BalanceRandom, BalanceWindow: 60, HedgeMax: 2, ListRefresh: 3600},
+		CacheConfig{ShardBy: ShardByHash},
+		S3CacheConfig{Region: "us-east-1", Timeout: 2000, UploadQueue: 1000, UploadMemory: 256, UploadWorkers: 4},
 	}
 
 	err := ini.StrictMapToWithMapper(config, ini.TitleUnderscore, path)
@@ -219,19 +414,57 @@ func readConfig(path string) *Config {
 		log.Fatal(err)
 	}
 
+	if config.DbConfig.FlushInterval <= 0 {
+		log.Fatalf("flush_interval must be positive, got %d", config.DbConfig.FlushInterval)
+	}
+
 	return config
 }
 
+func setPassword(config *DbConfig, user string) {
+	fmt.Fprintf(os.Stderr, "New password for %s: ", user)
+
+	pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && pass == "" {
+		log.Fatal(err)
+	}
+
+	pass = strings.TrimRight(pass, "\r\n")
+	if pass == "" {
+		log.Fatal("empty password")
+	}
+
+	ur := &UserRepository{db: initDb(config)}
+	if err := ur.SetPassword(user, pass); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("password of %s updated\n", user)
+}
+
 func initDb(config *DbConfig) *gorm.DB {
 	db, err := gorm.Open(mysql.Open(config.Dsn))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = db.AutoMigrate(&User{}, &Backend{}, &Article{})
+	err = db.AutoMigrate(&User{}, &Backend{}, &Article{}, &Rule{})
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// routing rules replaced hardcoded checks, an empty rules table
+	// gets their equivalents so that upgrades route as before
+	var rules int64
+	if err := db.Model(&Rule{}).Count(&rules).Error; err != nil {
+		log.Fatal(err)
+	}
+	if rules == 0 {
+		if err := db.Create(defaultRules()).Error; err != nil {
+			log.Fatal(err)
+		}
+		log.Println("[rules] default routing rules created")
+	}
+
 	return db
 }
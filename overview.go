@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/textproto"
+	"nntplexer/metrics"
+	"nntplexer/nntp"
+	"nntplexer/nntp/nntpclient"
+	"strconv"
+	"strings"
+)
+
+// Overview commands are served by backends flagged with Overview only.
+// Article ranges are numbers in session's group, so they are asked for
+// on the primary backend, message-ids fail over between overview backends.
+
+var errNoOverview = &textproto.Error{Code: 503, Msg: "Overview not available"}
+
+// HasOverview tells whether primary backend serves overview data,
+// without it ranges, the common use of OVER and HDR, always fail.
+func (b *NNTPBackend) HasOverview() bool {
+	be, ok := b.primaryBackend()
+	return ok && be.Overview
+}
+
+// Over streams overview of articles in rng of group, rng being
+// a message-id or an article range.
+func (b *NNTPBackend) Over(group string, rng string) (io.ReadCloser, error) {
+	return b.overview("over", group, rng, func(c *nntpclient.Client) (io.Reader, error) {
+		if strings.HasPrefix(rng, "<") {
+			// optional part of OVER, XOVER lacks it altogether
+			ok, err := c.HasCapability("OVER", "MSGID")
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errNoOverview
+			}
+		}
+		return c.Over(rng)
+	})
+}
+
+// Hdr streams values of header field of articles in rng of group.
+func (b *NNTPBackend) Hdr(group string, field string, rng string) (io.ReadCloser, error) {
+	return b.overview("hdr", group, rng, func(c *nntpclient.Client) (io.Reader, error) {
+		return c.Hdr(field, rng)
+	})
+}
+
+// overview runs list on a backend allowed to serve overview data,
+// the listing is read from connection checked out of the pool.
+func (b *NNTPBackend) overview(cmd string, group string, rng string, list func(c *nntpclient.Client) (io.Reader, error)) (io.ReadCloser, error) {
+	open := opening(func(c *nntpclient.Client) (*nntp.Article, error) {
+		r, err := list(c)
+		if err != nil {
+			return nil, err
+		}
+		return &nntp.Article{Body: r}, nil
+	})
+
+	if !strings.HasPrefix(rng, "<") {
+		if be, ok := b.primaryBackend(); ok && !be.Overview {
+			return nil, errNoOverview
+		}
+
+		a, err := b.onPrimary(cmd, group, open)
+		if err != nil {
+			return nil, err
+		}
+		return b.reader(a), nil
+	}
+
+	// 503 unless some backend could look message-ids up at all
+	var err error = errNoOverview
+	for _, be := range b.br.Get() {
+		if !be.Overview {
+			continue
+		}
+
+		a, terr := b.try(be, cmd, "", open)
+		if terr != nil {
+			if terr != errNoOverview {
+				err = &textproto.Error{Code: 430, Msg: "No such article"}
+			}
+			continue
+		}
+
+		metrics.BackendRequests.With(prometheus.Labels{"backend": a.be.Name, "code": strconv.Itoa(a.po.object.GetCode())}).Inc()
+		return b.reader(a), nil
+	}
+
+	return nil, err
+}
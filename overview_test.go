@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"nntplexer/nntp/nntpclient"
+	"testing"
+)
+
+// legacyObject connects a client to a fake backend knowing none of
+// the commands it is sent, CAPABILITIES included.
+func legacyObject() (*PooledObject, error) {
+	server, conn := net.Pipe()
+
+	go func() {
+		text := textproto.NewConn(server)
+		defer text.Close()
+
+		if err := text.PrintfLine("200 fake server ready"); err != nil {
+			return
+		}
+		for {
+			if _, err := text.ReadLine(); err != nil {
+				return
+			}
+			if err := text.PrintfLine("500 What?"); err != nil {
+				return
+			}
+		}
+	}()
+
+	client, err := nntpclient.NewClient(conn, &nntpclient.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PooledObject{object: client, valid: true}, nil
+}
+
+func TestOverview(t *testing.T) {
+	b := newGroupBackend()
+
+	if _, err := b.Over("misc.test", "<7@test>"); !hasCode(err, 503) {
+		t.Errorf("expected 503 without overview backends, got: %v", err)
+	}
+	if _, err := b.Over("misc.test", "7"); !hasCode(err, 503) {
+		t.Errorf("expected 503 from primary not serving overview, got: %v", err)
+	}
+	if b.HasOverview() {
+		t.Error("overview advertised without overview backends")
+	}
+
+	b.br.backends[0].Overview = true
+	if !b.HasOverview() {
+		t.Error("overview of primary backend not advertised")
+	}
+
+	r, err := b.Over("", "<7@test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "0\tseven\n" {
+		t.Errorf("unexpected overview %q: %v", data, err)
+	}
+
+	if _, err := b.Over("", "<8@test>"); !hasCode(err, 430) {
+		t.Errorf("expected 430 for unknown article, got: %v", err)
+	}
+}
+
+func TestOverviewMsgidUnsupported(t *testing.T) {
+	b := newGroupBackend()
+	b.br.backends[0].Overview = true
+	b.pp.pools["test"].factory = legacyObject
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.Over("", "<7@test>"); !hasCode(err, 503) {
+			t.Fatalf("expected 503 from backend without OVER MSGID, got: %v", err)
+		}
+	}
+
+	// missing feature isn't held against the backend
+	if score := b.rt.stats.Score("test"); score != (backendStat{latency: statsLatency}).score() {
+		t.Errorf("score changed to %v", score)
+	}
+}
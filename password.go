@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+)
+
+// HashPassword returns salted bcrypt hash of password to be stored in users table.
+func HashPassword(pass string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// CheckPassword verifies password against its stored hash. Besides bcrypt
+// hashes, legacy unsalted hex encoded SHA-256 ones are accepted, legacy
+// tells such hash should be replaced.
+func CheckPassword(hash string, pass string) (ok bool, legacy bool) {
+	if isLegacyHash(hash) {
+		h := sha256.Sum256([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(strings.ToLower(hash))) == 1, true
+	}
+
+	if hash == "" {
+		return false, false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil, false
+}
+
+func isLegacyHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// PasswordCache remembers passwords verified since start, as bcrypt is
+// deliberately slow and clients open dozens of connections at once.
+// Passwords are kept as HMAC with a random key, entry is only valid while
+// stored hash stays the same.
+type PasswordCache struct {
+	sync.Mutex
+	key     []byte
+	entries map[string]passwordEntry
+}
+
+type passwordEntry struct {
+	hash string
+	mac  []byte
+}
+
+func NewPasswordCache() *PasswordCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return &PasswordCache{
+		key:     key,
+		entries: make(map[string]passwordEntry),
+	}
+}
+
+// Check tells whether pass was verified against hash before.
+func (pc *PasswordCache) Check(user string, hash string, pass string) bool {
+	pc.Lock()
+	entry, ok := pc.entries[user]
+	pc.Unlock()
+
+	return ok && entry.hash == hash && hmac.Equal(entry.mac, pc.mac(user, pass))
+}
+
+// Add remembers pass was verified against hash.
+func (pc *PasswordCache) Add(user string, hash string, pass string) {
+	pc.Lock()
+	pc.entries[user] = passwordEntry{hash: hash, mac: pc.mac(user, pass)}
+	pc.Unlock()
+}
+
+func (pc *PasswordCache) mac(user string, pass string) []byte {
+	h := hmac.New(sha256.New, pc.key)
+	h.Write([]byte(user + "\x00" + pass))
+	return h.Sum(nil)
+}
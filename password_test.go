@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, legacy := CheckPassword(hash, "secret"); !ok || legacy {
+		t.Errorf("bcrypt hash: ok=%v legacy=%v", ok, legacy)
+	}
+	if ok, _ := CheckPassword(hash, "wrong"); ok {
+		t.Error("wrong password accepted")
+	}
+
+	// hex(sha256("secret"))
+	sha := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+
+	if ok, legacy := CheckPassword(sha, "secret"); !ok || !legacy {
+		t.Errorf("legacy hash: ok=%v legacy=%v", ok, legacy)
+	}
+	if ok, _ := CheckPassword(sha, "wrong"); ok {
+		t.Error("wrong password accepted for legacy hash")
+	}
+
+	if ok, _ := CheckPassword("", ""); ok {
+		t.Error("empty hash accepted")
+	}
+}
@@ -3,17 +3,29 @@ package main
 import (
 	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
 	"net"
+	"nntplexer/metrics"
 	"nntplexer/nntp/nntpclient"
 	"strconv"
 	"sync"
 	"time"
 )
 
+var (
+	errPoolClosed   = errors.New("pool is closed")
+	errPoolNotFound = errors.New("pool not found")
+)
+
 type PooledObject struct {
 	sync.Mutex
 	object *nntpclient.Client
 	valid  bool
+	// created is when connection was opened, returned when it was
+	// last put back to the pool
+	created  time.Time
+	returned time.Time
 }
 
 // Invalidate marks object as invalid.
@@ -24,8 +36,14 @@ func (po *PooledObject) Invalidate() {
 	po.Unlock()
 }
 
+// ClientPool keeps up to capacity connections to a backend. When all of
+// them are busy, Get waits up to maxWait for one to be returned, waiters
+// are served in FIFO order and at most maxWaiters of them are queued.
 type ClientPool struct {
 	sync.Mutex
+	name        string
+	settings    poolSettings
+	closed      bool
 	idle        []*PooledObject
 	active      []*PooledObject
 	capacity    int
@@ -34,71 +52,447 @@ type ClientPool struct {
 	failTimeout int
 	checked     time.Time
 	factory     func() (*PooledObject, error)
+	maxWait     time.Duration
+	maxWaiters  int
+	waiters     []chan *PooledObject
+	// slots freed by dropped connections and promised to waiters
+	reserved int
+	// slots held by connections of the pool this one replaced until
+	// they are closed, successor is the pool replacing this one
+	inherited int
+	successor *ClientPool
+
+	// idle connections are closed after idleTimeout, any connection
+	// after maxLifetime, minIdle ones are kept open in advance and
+	// connections idle for longer than keepalive are probed before use
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	keepalive   time.Duration
+	minIdle     int
 }
 
+// Get checks out a connection, probing it first if it idled for a while,
+// so that connections silently dropped by the backend don't fail requests.
 func (p *ClientPool) Get() (*PooledObject, error) {
+	for {
+		client, err := p.get()
+		if err != nil || p.keepalive == 0 || time.Since(client.returned) < p.keepalive {
+			return client, err
+		}
+
+		if _, err := client.object.Date(); err == nil {
+			return client, nil
+		}
+
+		metrics.PoolEvictions.With(prometheus.Labels{"backend": p.name, "reason": "keepalive"}).Inc()
+		client.Invalidate()
+		p.Return(client)
+	}
+}
+
+func (p *ClientPool) get() (*PooledObject, error) {
 	p.Lock()
-	defer p.Unlock()
 
-	now := time.Now()
+	if p.closed {
+		p.Unlock()
+		return nil, errPoolClosed
+	}
 
-	if len(p.idle) == 0 {
-		if len(p.active) == p.capacity {
-			return nil, errors.New("pool is busy")
+	// queued waiters go first, idle connections and free
+	// slots are handed over to them directly
+	if len(p.waiters) == 0 {
+		// connections past their lifetime are dropped on the way
+		for len(p.idle) > 0 && p.expired(p.idle[0], time.Now()) {
+			metrics.PoolEvictions.With(prometheus.Labels{"backend": p.name, "reason": "lifetime"}).Inc()
+			_ = p.idle[0].object.Close()
+			p.idle = p.idle[1:]
+		}
+
+		if len(p.idle) > 0 {
+			client := p.idle[0]
+			p.idle = p.idle[1:]
+			p.active = append(p.active, client)
+
+			p.Unlock()
+			return client, nil
 		}
 
-		// see nginx implementation
-		// https://github.com/nginx/nginx/blob/release-1.21.0/src/http/ngx_http_upstream_round_robin.c#L554
-		if p.maxFails > 0 &&
-			p.fails >= p.maxFails &&
-			now.Sub(p.checked) <= time.Duration(p.failTimeout)*time.Second {
-			// pool failure
-			return nil, errors.New("pool temporarily disabled")
+		if len(p.active)+p.reserved+p.inherited < p.capacity {
+			defer p.Unlock()
+			return p.create()
 		}
+	}
 
-		p.checked = now
+	if p.maxWait == 0 || len(p.waiters) >= p.maxWaiters {
+		p.Unlock()
+		metrics.PoolBusy.With(prometheus.Labels{"backend": p.name, "reason": "queue_full"}).Inc()
+		return nil, errors.New("pool is busy")
+	}
 
-		client, err := p.factory()
+	// buffered, so that handing over never blocks
+	waiter := make(chan *PooledObject, 1)
+	p.waiters = append(p.waiters, waiter)
+	metrics.PoolWaiters.With(prometheus.Labels{"backend": p.name}).Set(float64(len(p.waiters)))
+	p.Unlock()
 
-		// some error occured during new conn creation
-		if err != nil {
-			// increment fails
-			p.fails++
-			if p.fails >= p.maxFails {
-				return nil, fmt.Errorf("pool temporarily disabled: %v", err)
-			}
-			return nil, err
+	start := time.Now()
+	timer := time.NewTimer(p.maxWait)
+	defer timer.Stop()
+
+	select {
+	case client := <-waiter:
+		metrics.PoolWaitSeconds.With(prometheus.Labels{"backend": p.name}).Observe(time.Since(start).Seconds())
+		return p.handover(client)
+	case <-timer.C:
+		p.Lock()
+		if p.dequeue(waiter) {
+			p.Unlock()
+			metrics.PoolWaitSeconds.With(prometheus.Labels{"backend": p.name}).Observe(time.Since(start).Seconds())
+			metrics.PoolBusy.With(prometheus.Labels{"backend": p.name, "reason": "timeout"}).Inc()
+			return nil, errors.New("pool is busy")
 		}
+		p.Unlock()
 
-		p.fails = 0
-		p.active = append(p.active, client)
+		// connection was handed over meanwhile
+		metrics.PoolWaitSeconds.With(prometheus.Labels{"backend": p.name}).Observe(time.Since(start).Seconds())
+		return p.handover(<-waiter)
+	}
+}
 
+// handover takes connection passed to a waiter, nil stands for a slot
+// freed by a dropped connection, so a new one is created in its place.
+func (p *ClientPool) handover(client *PooledObject) (*PooledObject, error) {
+	if client != nil {
 		return client, nil
-	} else {
-		client := p.idle[0]
-		p.idle = p.idle[1:]
-		p.active = append(p.active, client)
+	}
 
-		return client, nil
+	p.Lock()
+	defer p.Unlock()
+
+	p.reserved--
+	return p.create()
+}
+
+// create connects a new client, pool must be locked.
+func (p *ClientPool) create() (*PooledObject, error) {
+	if p.closed {
+		return nil, errPoolClosed
+	}
+
+	now := time.Now()
+
+	if p.disabled(now) {
+		// pool failure
+		p.release()
+		return nil, errors.New("pool temporarily disabled")
 	}
+
+	p.checked = now
+
+	client, err := p.dial()
+
+	// some error occured during new conn creation
+	if err != nil {
+		// slot stays free, let the next waiter try
+		p.release()
+
+		// increment fails
+		p.fails++
+		if p.fails >= p.maxFails {
+			return nil, fmt.Errorf("pool temporarily disabled: %v", err)
+		}
+		return nil, err
+	}
+
+	p.fails = 0
+	p.active = append(p.active, client)
+
+	return client, nil
+}
+
+// dial opens a new connection.
+func (p *ClientPool) dial() (*PooledObject, error) {
+	client, err := p.factory()
+	if err != nil {
+		return nil, err
+	}
+
+	client.created = time.Now()
+	client.returned = client.created
+
+	return client, nil
+}
+
+// disabled tells whether pool is disabled after too many failures,
+// pool must be locked.
+func (p *ClientPool) disabled(now time.Time) bool {
+	// see nginx implementation
+	// https://github.com/nginx/nginx/blob/release-1.21.0/src/http/ngx_http_upstream_round_robin.c#L554
+	return p.maxFails > 0 &&
+		p.fails >= p.maxFails &&
+		now.Sub(p.checked) <= time.Duration(p.failTimeout)*time.Second
+}
+
+// expired tells whether connection outlived maxLifetime.
+func (p *ClientPool) expired(po *PooledObject, now time.Time) bool {
+	return p.maxLifetime > 0 && now.Sub(po.created) > p.maxLifetime
+}
+
+// release passes a free slot to the first waiter, pool must be locked.
+func (p *ClientPool) release() {
+	if waiter := p.next(); waiter != nil {
+		p.reserved++
+		waiter <- nil
+	}
+}
+
+// free passes slot of a closed connection on, to the successor of
+// a replaced pool, to the first waiter otherwise. Pool must be locked.
+func (p *ClientPool) free() {
+	if p.successor != nil {
+		p.successor.freeInherited()
+		return
+	}
+	p.release()
+}
+
+// freeInherited frees slot held by a closed connection of the replaced pool.
+func (p *ClientPool) freeInherited() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.inherited--
+	p.free()
+}
+
+// replace closes pool and makes successor take over slots of connections
+// still active in it, so that the backend doesn't see more connections
+// than capacity while pool drains. Both happen at once, connections
+// returned later are always passed on and none are checked out anymore.
+// Successor must not be in use yet.
+func (p *ClientPool) replace(successor *ClientPool) {
+	p.Lock()
+	p.successor = successor
+	successor.inherited = len(p.active) + p.inherited
+	idle := p.drain()
+	p.Unlock()
+
+	for _, po := range idle {
+		_ = po.object.Close()
+	}
+}
+
+// next dequeues the first waiter, pool must be locked.
+func (p *ClientPool) next() chan *PooledObject {
+	if len(p.waiters) == 0 {
+		return nil
+	}
+
+	waiter := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	metrics.PoolWaiters.With(prometheus.Labels{"backend": p.name}).Set(float64(len(p.waiters)))
+
+	return waiter
+}
+
+// dequeue removes waiter which gave up, false means it was served already.
+func (p *ClientPool) dequeue(waiter chan *PooledObject) bool {
+	for index, w := range p.waiters {
+		if w == waiter {
+			p.waiters = append(p.waiters[:index], p.waiters[index+1:]...)
+			metrics.PoolWaiters.With(prometheus.Labels{"backend": p.name}).Set(float64(len(p.waiters)))
+			return true
+		}
+	}
+	return false
 }
 
 func (p *ClientPool) Return(po *PooledObject) {
 	p.Lock()
 	defer p.Unlock()
+	now := time.Now()
 	for index, c := range p.active {
 		if c == po {
+			if po.valid && p.expired(po, now) {
+				metrics.PoolEvictions.With(prometheus.Labels{"backend": p.name, "reason": "lifetime"}).Inc()
+				po.Invalidate()
+			}
+
+			po.returned = now
+			if p.closed {
+				po.Invalidate()
+			}
+
 			if po.valid {
+				// hand over to the first waiter, connection stays active
+				if waiter := p.next(); waiter != nil {
+					waiter <- po
+					return
+				}
 				p.idle = append(p.idle, po)
 			} else {
 				_ = po.object.Close()
 			}
 			p.active = append(p.active[:index], p.active[index+1:]...)
+
+			if !po.valid {
+				p.free()
+			}
 			break
 		}
 	}
 }
 
+// Close drains pool, idle connections are closed right away, active ones
+// once they are returned, queued requests fail.
+func (p *ClientPool) Close() {
+	p.Lock()
+	idle := p.drain()
+	p.Unlock()
+
+	for _, po := range idle {
+		_ = po.object.Close()
+	}
+}
+
+// drain marks pool closed and fails queued requests, returns idle
+// connections to be closed. Pool must be locked.
+func (p *ClientPool) drain() []*PooledObject {
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+
+	// waiters get a free slot, which turns into an error on a closed pool
+	for len(p.waiters) > 0 {
+		p.release()
+	}
+
+	return idle
+}
+
+// Maintain closes connections idle for too long or past their lifetime
+// and opens new ones until there are minIdle of them.
+func (p *ClientPool) Maintain() {
+	now := time.Now()
+
+	p.Lock()
+	var closing []*PooledObject
+	idle := p.idle[:0]
+	for _, po := range p.idle {
+		switch {
+		case p.expired(po, now):
+			metrics.PoolEvictions.With(prometheus.Labels{"backend": p.name, "reason": "lifetime"}).Inc()
+			closing = append(closing, po)
+		case p.idleTimeout > 0 && now.Sub(po.returned) > p.idleTimeout:
+			metrics.PoolEvictions.With(prometheus.Labels{"backend": p.name, "reason": "idle"}).Inc()
+			closing = append(closing, po)
+		default:
+			idle = append(idle, po)
+		}
+	}
+	p.idle = idle
+	p.Unlock()
+
+	for _, po := range closing {
+		_ = po.object.Close()
+	}
+
+	for p.prewarm() {
+	}
+}
+
+// prewarm opens an idle connection if there are less than minIdle,
+// returns whether it did.
+func (p *ClientPool) prewarm() bool {
+	p.Lock()
+	if p.closed || len(p.idle) >= p.minIdle || len(p.waiters) > 0 ||
+		len(p.idle)+len(p.active)+p.reserved+p.inherited >= p.capacity || p.disabled(time.Now()) {
+		p.Unlock()
+		return false
+	}
+	// keep the slot while dialing without holding the lock
+	p.reserved++
+	p.Unlock()
+
+	client, err := p.dial()
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.reserved--
+	p.checked = time.Now()
+
+	if err == nil && p.closed {
+		_ = client.object.Close()
+		return false
+	}
+
+	if err != nil {
+		log.Printf("[pool] [%s] prewarm: %v\n", p.name, err)
+		p.fails++
+		p.release()
+		return false
+	}
+
+	p.fails = 0
+
+	// a request might have queued up meanwhile
+	if waiter := p.next(); waiter != nil {
+		p.active = append(p.active, client)
+		waiter <- client
+		return true
+	}
+	p.idle = append(p.idle, client)
+
+	return true
+}
+
+// poolSettings are backend fields a pool is built from,
+// pool is rebuilt once any of them changes.
+type poolSettings struct {
+	Host           string
+	Port           uint16
+	User           string
+	Pass           string
+	UseTLS         bool
+	MaxConns       uint16
+	MaxWait        uint32
+	MaxWaiters     uint16
+	MaxFails       uint16
+	FailTimeout    uint16
+	IdleTimeout    uint32
+	MaxLifetime    uint32
+	Keepalive      uint32
+	MinIdle        uint16
+	ConnectTimeout uint32
+	ReadTimeout    uint32
+	WriteTimeout   uint32
+	CommandTimeout uint32
+}
+
+func settingsOf(backend Backend) poolSettings {
+	return poolSettings{
+		Host:           backend.Host,
+		Port:           backend.Port,
+		User:           backend.User,
+		Pass:           backend.Pass,
+		UseTLS:         backend.UseTLS,
+		MaxConns:       backend.MaxConns,
+		MaxWait:        backend.MaxWait,
+		MaxWaiters:     backend.MaxWaiters,
+		MaxFails:       backend.MaxFails,
+		FailTimeout:    backend.FailTimeout,
+		IdleTimeout:    backend.IdleTimeout,
+		MaxLifetime:    backend.MaxLifetime,
+		Keepalive:      backend.Keepalive,
+		MinIdle:        backend.MinIdle,
+		ConnectTimeout: backend.ConnectTimeout,
+		ReadTimeout:    backend.ReadTimeout,
+		WriteTimeout:   backend.WriteTimeout,
+		CommandTimeout: backend.CommandTimeout,
+	}
+}
+
 type PoolProvider struct {
 	sync.Mutex
 	pools map[string]*ClientPool
@@ -110,47 +504,120 @@ func NewPoolProvider() *PoolProvider {
 	}
 }
 
-func (cp *PoolProvider) GetPool(backend Backend) *ClientPool {
+// GetPool returns pool of backend by name. Pools are only built by Sync,
+// requests holding backend settings older or newer than the pool's ones
+// still get it.
+func (cp *PoolProvider) GetPool(name string) (*ClientPool, bool) {
 	cp.Lock()
 	defer cp.Unlock()
 
-	if _, ok := cp.pools[backend.Name]; !ok {
-		cp.pools[backend.Name] = &ClientPool{
-			Mutex:       sync.Mutex{},
-			idle:        make([]*PooledObject, 0, backend.MaxConns),
-			active:      make([]*PooledObject, 0, backend.MaxConns),
-			capacity:    int(backend.MaxConns),
-			fails:       0,
-			maxFails:    int(backend.MaxFails),
-			failTimeout: int(backend.FailTimeout),
-			factory: func() (*PooledObject, error) {
-				addr := net.JoinHostPort(backend.Host, strconv.Itoa(int(backend.Port)))
-
-				client, err := nntpclient.Dial(addr, &nntpclient.Config{
-					ReadTimeout:    0,
-					WriteTimeout:   0,
-					ConnectTimeout: int(backend.ConnectTimeout),
-					Encryption:     backend.UseTLS,
-				})
-				if err != nil {
-					return nil, err
-				}
+	pool, ok := cp.pools[name]
+	return pool, ok
+}
 
-				authenticate, err := client.Authenticate(backend.User, backend.Pass)
-				if err != nil {
-					_ = client.Close()
-					return nil, err
-				}
+// Sync builds pools of new backends, rebuilds pools of changed ones and
+// closes pools of backends which were removed or disabled.
+func (cp *PoolProvider) Sync(backends []Backend) {
+	cp.Lock()
+	defer cp.Unlock()
 
-				if !authenticate {
-					_ = client.Close()
-					return nil, errors.New("authentication failed")
-				}
+	current := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		current[backend.Name] = true
+
+		old, ok := cp.pools[backend.Name]
+		if ok && old.settings == settingsOf(backend) {
+			continue
+		}
+
+		pool := newClientPool(backend)
+		cp.pools[backend.Name] = pool
+
+		if ok {
+			log.Printf("[pool] [%s] settings changed, rebuilding pool\n", backend.Name)
+			metrics.PoolRebuilds.With(prometheus.Labels{"backend": backend.Name, "reason": "changed"}).Inc()
+			old.replace(pool)
+		}
+	}
+
+	for name, pool := range cp.pools {
+		if !current[name] {
+			log.Printf("[pool] [%s] backend removed, closing pool\n", name)
+			metrics.PoolRebuilds.With(prometheus.Labels{"backend": name, "reason": "removed"}).Inc()
+			delete(cp.pools, name)
+			go pool.Close()
+		}
+	}
+}
+
+func newClientPool(backend Backend) *ClientPool {
+	maxWaiters := int(backend.MaxWaiters)
+	if maxWaiters == 0 {
+		maxWaiters = int(backend.MaxConns)
+	}
+
+	return &ClientPool{
+		Mutex:       sync.Mutex{},
+		name:        backend.Name,
+		settings:    settingsOf(backend),
+		idle:        make([]*PooledObject, 0, backend.MaxConns),
+		active:      make([]*PooledObject, 0, backend.MaxConns),
+		capacity:    int(backend.MaxConns),
+		fails:       0,
+		maxFails:    int(backend.MaxFails),
+		failTimeout: int(backend.FailTimeout),
+		maxWait:     time.Duration(backend.MaxWait) * time.Millisecond,
+		maxWaiters:  maxWaiters,
+		idleTimeout: time.Duration(backend.IdleTimeout) * time.Second,
+		maxLifetime: time.Duration(backend.MaxLifetime) * time.Second,
+		keepalive:   time.Duration(backend.Keepalive) * time.Second,
+		minIdle:     int(backend.MinIdle),
+		factory: func() (*PooledObject, error) {
+			addr := net.JoinHostPort(backend.Host, strconv.Itoa(int(backend.Port)))
+
+			client, err := nntpclient.Dial(addr, &nntpclient.Config{
+				ReadTimeout:    int(backend.ReadTimeout),
+				WriteTimeout:   int(backend.WriteTimeout),
+				CommandTimeout: int(backend.CommandTimeout),
+				ConnectTimeout: int(backend.ConnectTimeout),
+				Encryption:     backend.UseTLS,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			authenticate, err := client.Authenticate(backend.User, backend.Pass)
+			if err != nil {
+				_ = client.Close()
+				return nil, err
+			}
+
+			if !authenticate {
+				_ = client.Close()
+				return nil, errors.New("authentication failed")
+			}
 
-				return &PooledObject{object: client, valid: true}, nil
-			},
+			return &PooledObject{object: client, valid: true}, nil
+		},
+	}
+}
+
+// Maintain runs maintenance of backends' pools in parallel.
+func (cp *PoolProvider) Maintain(backends []Backend) {
+	var wg sync.WaitGroup
+
+	for _, backend := range backends {
+		pool, ok := cp.GetPool(backend.Name)
+		if !ok {
+			continue
 		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.Maintain()
+		}()
 	}
 
-	return cp.pools[backend.Name]
+	wg.Wait()
 }
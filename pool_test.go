@@ -0,0 +1,356 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"nntplexer/nntp/nntpclient"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPool(capacity int, maxWait time.Duration, maxWaiters int) *ClientPool {
+	return &ClientPool{
+		name:       "test",
+		capacity:   capacity,
+		maxWait:    maxWait,
+		maxWaiters: maxWaiters,
+		factory:    pipeObject,
+	}
+}
+
+// pipeObject connects a client to a fake backend answering DATE only.
+func pipeObject() (*PooledObject, error) {
+	return bodyObject("430 No such article\r\n")()
+}
+
+// bodyObject makes pipeObject answering BODY with raw response. A body
+// response missing the terminating dot is cut short, the fake backend
+// hangs up after sending it.
+func bodyObject(response string) func() (*PooledObject, error) {
+	return func() (*PooledObject, error) {
+		return pipeServer(response)
+	}
+}
+
+func pipeServer(response string) (*PooledObject, error) {
+	server, conn := net.Pipe()
+
+	go func() {
+		text := textproto.NewConn(server)
+		defer text.Close()
+
+		if err := text.PrintfLine("200 fake server ready"); err != nil {
+			return
+		}
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(line, "BODY ") {
+				if err := text.PrintfLine("111 20210615123456"); err != nil {
+					return
+				}
+				continue
+			}
+
+			if _, err := text.W.WriteString(response); err != nil {
+				return
+			}
+			if err := text.W.Flush(); err != nil {
+				return
+			}
+			if strings.HasPrefix(response, "222 ") && !strings.HasSuffix(response, "\r\n.\r\n") {
+				return
+			}
+		}
+	}()
+
+	client, err := nntpclient.NewClient(conn, &nntpclient.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PooledObject{object: client, valid: true}, nil
+}
+
+func TestPoolBusy(t *testing.T) {
+	p := newTestPool(1, 0, 0)
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(); err == nil {
+		t.Fatal("expected busy pool without waiting")
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	p := newTestPool(1, 50*time.Millisecond, 1)
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := p.Get(); err == nil {
+		t.Fatal("expected busy pool after waiting")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("gave up after %v only", elapsed)
+	}
+	if len(p.waiters) != 0 {
+		t.Errorf("waiter left in queue")
+	}
+}
+
+func TestPoolHandoverFifo(t *testing.T) {
+	p := newTestPool(1, time.Second, 2)
+
+	po, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var served []int
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			po, err := p.Get()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// connection is held, so appends are serialized
+			served = append(served, i)
+			p.Return(po)
+		}(i)
+
+		// make queue order deterministic
+		for {
+			p.Lock()
+			queued := len(p.waiters)
+			p.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// queue is full
+	if _, err := p.Get(); err == nil {
+		t.Error("expected full queue to refuse")
+	}
+
+	p.Return(po)
+	wg.Wait()
+
+	if len(served) != 2 || served[0] != 0 || served[1] != 1 {
+		t.Errorf("expected waiters served in order, got %v", served)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if len(p.active) != 0 || len(p.idle) != 1 {
+		t.Errorf("expected single idle connection, got %d active, %d idle", len(p.active), len(p.idle))
+	}
+}
+
+func TestPoolMaintain(t *testing.T) {
+	p := newTestPool(4, 0, 0)
+	p.minIdle = 2
+	p.idleTimeout = time.Minute
+
+	p.Maintain()
+	if len(p.idle) != 2 {
+		t.Fatalf("expected 2 prewarmed connections, got %d", len(p.idle))
+	}
+
+	// connection idle for too long is replaced
+	stale := p.idle[0]
+	stale.returned = time.Now().Add(-2 * time.Minute)
+
+	p.Maintain()
+	if len(p.idle) != 2 {
+		t.Fatalf("expected 2 idle connections, got %d", len(p.idle))
+	}
+	for _, po := range p.idle {
+		if po == stale {
+			t.Error("stale connection kept")
+		}
+	}
+}
+
+func TestPoolMaxLifetime(t *testing.T) {
+	p := newTestPool(1, 0, 0)
+	p.maxLifetime = time.Minute
+
+	po, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	po.created = time.Now().Add(-2 * time.Minute)
+	p.Return(po)
+
+	if len(p.idle) != 0 || len(p.active) != 0 {
+		t.Fatalf("expired connection kept, %d idle, %d active", len(p.idle), len(p.active))
+	}
+}
+
+func TestPoolKeepalive(t *testing.T) {
+	p := newTestPool(1, 0, 0)
+	p.keepalive = time.Minute
+
+	po, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Return(po)
+
+	// connection dropped by backend meanwhile
+	po.returned = time.Now().Add(-2 * time.Minute)
+	_ = po.object.Close()
+
+	fresh, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == po {
+		t.Error("dead connection reused")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p := newTestPool(1, time.Second, 1)
+
+	po, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan error)
+	go func() {
+		_, err := p.Get()
+		waited <- err
+	}()
+	for {
+		p.Lock()
+		queued := len(p.waiters)
+		p.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	p.Close()
+
+	if err := <-waited; err != errPoolClosed {
+		t.Errorf("expected waiter to fail with closed pool, got: %v", err)
+	}
+
+	p.Return(po)
+	if len(p.active) != 0 || len(p.idle) != 0 {
+		t.Errorf("connection kept in closed pool, %d active, %d idle", len(p.active), len(p.idle))
+	}
+}
+
+func TestPoolProviderSync(t *testing.T) {
+	pp := NewPoolProvider()
+
+	pp.Sync([]Backend{{Name: "a", Host: "h1", MaxConns: 1}, {Name: "b", Host: "h2", MaxConns: 1}})
+	a := pp.pools["a"]
+
+	// traffic counters are not pool settings
+	pp.Sync([]Backend{{Name: "a", Host: "h1", MaxConns: 1, RxBytes: 100}, {Name: "b", Host: "h2", MaxConns: 1}})
+	if pp.pools["a"] != a {
+		t.Error("pool rebuilt without settings change")
+	}
+
+	pp.Sync([]Backend{{Name: "a", Host: "h3", MaxConns: 1}})
+	if pp.pools["a"] == a {
+		t.Error("pool not rebuilt on host change")
+	}
+	if _, ok := pp.pools["b"]; ok {
+		t.Error("pool of removed backend kept")
+	}
+
+	for i := 0; ; i++ {
+		a.Lock()
+		closed := a.closed
+		a.Unlock()
+		if closed {
+			break
+		}
+		if i == 100 {
+			t.Fatal("old pool not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolReplaceKeepsCapacity(t *testing.T) {
+	old := newTestPool(3, 0, 0)
+	var active [3]*PooledObject
+	for i := range active {
+		po, err := old.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		active[i] = po
+	}
+	old.Return(active[2])
+	draining := active[1]
+
+	p := newTestPool(2, time.Second, 1)
+	old.replace(p)
+
+	// a request still holding the old pool neither gets its idle
+	// connection nor dials a new one
+	if _, err := old.Get(); err != errPoolClosed {
+		t.Fatalf("expected replaced pool closed, got: %v", err)
+	}
+
+	// returned before Close runs, the connection is closed and its slot passed on
+	old.Return(active[0])
+	if len(old.idle) != 0 || p.inherited != 1 {
+		t.Fatalf("expected connection closed and its slot passed on, %d idle, %d inherited", len(old.idle), p.inherited)
+	}
+	old.Close()
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the slot left is held by connection of the old pool
+	got := make(chan error)
+	go func() {
+		_, err := p.Get()
+		got <- err
+	}()
+	for {
+		p.Lock()
+		queued := len(p.waiters)
+		p.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	old.Return(draining)
+	if err := <-got; err != nil {
+		t.Fatalf("expected slot of closed connection passed on, got: %v", err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.inherited != 0 || len(p.active) != 2 {
+		t.Errorf("expected 2 active connections and no inherited slots, got %d, %d", len(p.active), p.inherited)
+	}
+}
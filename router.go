@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"nntplexer/metrics"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// RuleSkip removes matching backends from the route.
+	RuleSkip = "skip"
+	// RulePrefer moves matching backends in front of the others.
+	RulePrefer = "prefer"
+	// RuleOnly removes all backends but matching ones from the route.
+	RuleOnly = "only"
+)
+
+// Router decides which backends and in what order are asked for an article.
+//
+// Rules are applied one after another in priority order, each rule
+// reshaping the route left by the previous one. A rule applies when the
+// command and message-id match, its action then affects backends matching
+// rule's backend name and tag.
+//
+// Before rules are applied, backends of the same priority are ordered
+// by their recent performance according to mode, see BackendStats.
+type Router struct {
+	rr    *RuleRepository
+	stats *BackendStats
+	mode  string
+}
+
+// Route returns backends to try for cmd and messageId.
+// Passed backends slice isn't modified.
+func (rt *Router) Route(cmd string, messageId string, backends []Backend) []Backend {
+	route := rt.balance(backends)
+
+	for _, rule := range rt.rr.Get() {
+		if !rule.matchRequest(cmd, messageId) {
+			continue
+		}
+		route = rule.apply(route)
+	}
+
+	return route
+}
+
+// Observe records outcome of a request to backend for balancing.
+func (rt *Router) Observe(backend string, outcome int, latency time.Duration) {
+	if rt.stats != nil {
+		rt.stats.Observe(backend, outcome, latency)
+	}
+}
+
+// Retain drops backends whose retention can't hold an article posted at date.
+// Zero date means post date is unknown, route is left as is then.
+func (rt *Router) Retain(route []Backend, date time.Time) []Backend {
+	if date.IsZero() {
+		return route
+	}
+
+	age := time.Since(date)
+	retained := make([]Backend, 0, len(route))
+
+	for _, be := range route {
+		if be.Retention > 0 && age > time.Duration(be.Retention)*24*time.Hour {
+			metrics.BackendSkips.With(prometheus.Labels{"backend": be.Name, "reason": "retention"}).Inc()
+			continue
+		}
+		retained = append(retained, be)
+	}
+
+	return retained
+}
+
+// hasRetention tells whether any of backends has limited retention.
+func hasRetention(backends []Backend) bool {
+	for _, be := range backends {
+		if be.Retention > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compile validates rule and prepares its regexps.
+func (r *Rule) compile() error {
+	var err error
+
+	switch r.Action {
+	case RuleSkip, RulePrefer, RuleOnly:
+	default:
+		return fmt.Errorf("unknown action: %q", r.Action)
+	}
+
+	if r.MessageId != "" {
+		if r.messageId, err = regexp.Compile(r.MessageId); err != nil {
+			return err
+		}
+	}
+
+	if r.Backend != "" {
+		if r.backend, err = regexp.Compile(r.Backend); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Rule) matchRequest(cmd string, messageId string) bool {
+	if r.Command != "" && !r.matchCommand(cmd) {
+		return false
+	}
+
+	// rule without message conditions applies to every article
+	if r.messageId == nil && r.Domain == "" {
+		return true
+	}
+
+	matched := (r.messageId == nil || r.messageId.MatchString(messageId)) &&
+		(r.Domain == "" || matchDomain(messageIdDomain(messageId), r.Domain))
+
+	return matched != r.Negate
+}
+
+func (r *Rule) matchCommand(cmd string) bool {
+	for _, c := range strings.Split(r.Command, ",") {
+		if strings.EqualFold(strings.TrimSpace(c), cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchBackend(be Backend) bool {
+	if r.backend != nil && !r.backend.MatchString(be.Name) {
+		return false
+	}
+	if r.Tag != "" && !be.HasTag(r.Tag) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) apply(backends []Backend) []Backend {
+	matched := make([]Backend, 0, len(backends))
+	rest := make([]Backend, 0, len(backends))
+
+	for _, be := range backends {
+		if r.matchBackend(be) {
+			matched = append(matched, be)
+		} else {
+			rest = append(rest, be)
+		}
+	}
+
+	switch r.Action {
+	case RuleSkip:
+		return rest
+	case RuleOnly:
+		return matched
+	case RulePrefer:
+		return append(matched, rest...)
+	}
+
+	return backends
+}
+
+// messageIdDomain returns part of message-id after the last '@'.
+func messageIdDomain(messageId string) string {
+	id := strings.TrimSuffix(strings.TrimPrefix(messageId, "<"), ">")
+	if i := strings.LastIndex(id, "@"); i >= 0 {
+		return id[i+1:]
+	}
+	return ""
+}
+
+// matchDomain tells whether domain is either equal to or a subdomain of parent.
+func matchDomain(domain string, parent string) bool {
+	domain = strings.ToLower(domain)
+	parent = strings.ToLower(strings.TrimPrefix(parent, "."))
+
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
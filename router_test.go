@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRouter(t *testing.T, rules ...Rule) *Router {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Router{rr: &RuleRepository{rules: rules}}
+}
+
+func routeNames(route []Backend) []string {
+	names := make([]string, len(route))
+	for i, be := range route {
+		names[i] = be.Name
+	}
+	return names
+}
+
+func assertRoute(t *testing.T, route []Backend, expected ...string) {
+	t.Helper()
+
+	names := routeNames(route)
+	if len(names) != len(expected) {
+		t.Fatalf("expected route %v, got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("expected route %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	backends := []Backend{
+		{Name: "giga1"},
+		{Name: "ninja1", Tags: "block"},
+		{Name: "xsnews1"},
+		{Name: "eweka1", Tags: "block, cheap"},
+	}
+
+	rt := newTestRouter(t,
+		Rule{Domain: "giganews.com", Backend: "giga", Action: RuleSkip},
+		Rule{Command: "body", MessageId: "-newzNZB-|@nyuu", Negate: true, Backend: "ninja", Action: RuleSkip},
+		Rule{Command: "article,head", Tag: "cheap", Action: RulePrefer},
+	)
+
+	assertRoute(t, rt.Route("body", "<part1@news.giganews.com>", backends), "xsnews1", "eweka1")
+	assertRoute(t, rt.Route("body", "<part1@nyuu>", backends), "giga1", "ninja1", "xsnews1", "eweka1")
+	assertRoute(t, rt.Route("article", "<part1@example.com>", backends), "eweka1", "giga1", "ninja1", "xsnews1")
+	assertRoute(t, rt.Route("stat", "<part1@example.com>", backends), "giga1", "ninja1", "xsnews1", "eweka1")
+
+	// source backends must stay intact
+	assertRoute(t, backends, "giga1", "ninja1", "xsnews1", "eweka1")
+}
+
+func TestRouteOnly(t *testing.T) {
+	backends := []Backend{
+		{Name: "a"},
+		{Name: "b", Tags: "block"},
+		{Name: "c", Tags: "block"},
+	}
+
+	rt := newTestRouter(t,
+		Rule{MessageId: `^<only-block\.`, Tag: "block", Action: RuleOnly},
+	)
+
+	assertRoute(t, rt.Route("article", "<only-block.1@x>", backends), "b", "c")
+	assertRoute(t, rt.Route("article", "<any.1@x>", backends), "a", "b", "c")
+}
+
+func TestRuleCompile(t *testing.T) {
+	if err := (&Rule{Action: "drop"}).compile(); err == nil {
+		t.Error("unknown action accepted")
+	}
+	if err := (&Rule{Action: RuleSkip, MessageId: "("}).compile(); err == nil {
+		t.Error("invalid regexp accepted")
+	}
+}
+
+func TestRetain(t *testing.T) {
+	backends := []Backend{
+		{Name: "short", Retention: 30},
+		{Name: "long", Retention: 4000},
+		{Name: "unlimited"},
+	}
+
+	rt := newTestRouter(t)
+
+	assertRoute(t, rt.Retain(backends, time.Time{}), "short", "long", "unlimited")
+	assertRoute(t, rt.Retain(backends, time.Now().AddDate(0, 0, -10)), "short", "long", "unlimited")
+	assertRoute(t, rt.Retain(backends, time.Now().AddDate(0, 0, -100)), "long", "unlimited")
+	assertRoute(t, rt.Retain(backends, time.Now().AddDate(-20, 0, 0)), "unlimited")
+}
+
+func TestBalanceBest(t *testing.T) {
+	rt := newTestRouter(t)
+	rt.stats = NewBackendStats(time.Minute)
+	rt.mode = BalanceBest
+
+	backends := []Backend{
+		{Name: "slow", Priority: 1},
+		{Name: "fast", Priority: 1},
+		{Name: "other", Priority: 2},
+		{Name: "failing", Priority: 3},
+		{Name: "unknown", Priority: 3},
+	}
+
+	for i := 0; i < 10; i++ {
+		rt.Observe("slow", OutcomeOk, time.Second)
+		rt.Observe("fast", OutcomeOk, 10*time.Millisecond)
+		rt.Observe("failing", OutcomeFailed, 0)
+	}
+
+	assertRoute(t, rt.Route("body", "<a@b>", backends), "fast", "slow", "other", "unknown", "failing")
+	assertRoute(t, backends, "slow", "fast", "other", "failing", "unknown")
+}
+
+func TestBalanceRandom(t *testing.T) {
+	rt := newTestRouter(t)
+	rt.stats = NewBackendStats(time.Minute)
+	rt.mode = BalanceRandom
+
+	backends := []Backend{
+		{Name: "degraded", Priority: 1},
+		{Name: "healthy", Priority: 1},
+	}
+
+	for i := 0; i < 20; i++ {
+		rt.Observe("degraded", OutcomeMissing, 100*time.Millisecond)
+		rt.Observe("healthy", OutcomeOk, 100*time.Millisecond)
+	}
+
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		first[rt.Route("body", "<a@b>", backends)[0].Name]++
+	}
+
+	// both get load, the healthy one most of it
+	if first["degraded"] == 0 || first["healthy"] < 700 {
+		t.Errorf("unexpected spread %v", first)
+	}
+}
+
+func TestBackendStatsFade(t *testing.T) {
+	bs := NewBackendStats(time.Minute)
+	bs.Observe("a", OutcomeFailed, 0)
+
+	fresh := bs.Score("a")
+	bs.stats["a"].updated = time.Now().Add(-10 * time.Minute)
+
+	if faded := bs.Score("a"); faded <= fresh {
+		t.Errorf("score didn't recover: %v <= %v", faded, fresh)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"nntplexer/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	s3MetaKind    = "X-Amz-Meta-Kind"
+	s3MetaExpires = "X-Amz-Meta-Expires"
+
+	// s3MaxObject caps article size buffered for upload
+	s3MaxObject = 16 * 1024 * 1024
+)
+
+var s3EmptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// S3Config describes a bucket of an S3 compatible object storage.
+type S3Config struct {
+	Endpoint  string // e.g. https://<account>.r2.cloudflarestorage.com
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Cache is a remote article cache tier kept in S3 compatible storage,
+// so that nodes on different continents can share fetched articles.
+//
+// Objects use the same layout as DiskCache files. Object expiry time is
+// stored in its metadata, expired objects are misses, removing them is
+// left to bucket lifecycle rules. Uploads are queued and done in
+// background, articles are dropped rather than uploaded when queue is full
+// or buffering them would take more than maxBuffered bytes.
+type S3Cache struct {
+	// bytes of articles being buffered, queued or uploaded, first
+	// for 64-bit alignment of atomic operations
+	buffered    int64
+	maxBuffered int64
+
+	config  S3Config
+	ttl     time.Duration
+	timeout time.Duration // response headers and each body read
+	client  *http.Client
+	uploads chan *s3Upload
+}
+
+type s3Upload struct {
+	key     string
+	article bool
+	data    []byte
+}
+
+func NewS3Cache(config S3Config, ttl time.Duration, timeout time.Duration, queue int, maxBuffered int64, workers int) *S3Cache {
+	sc := &S3Cache{
+		maxBuffered: maxBuffered,
+		config:      config,
+		ttl:         ttl,
+		timeout:     timeout,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConnsPerHost:   workers + 16,
+			},
+		},
+		uploads: make(chan *s3Upload, queue),
+	}
+
+	for i := 0; i < workers; i++ {
+		go sc.upload()
+	}
+
+	return sc
+}
+
+func (sc *S3Cache) Get(cmd string, messageId string) (textproto.MIMEHeader, io.ReadCloser, bool) {
+	if cmd != "article" && cmd != "body" {
+		return nil, nil, false
+	}
+
+	// transport timeouts end with response headers, a body which stalls
+	// afterwards would hang the session reading it, so request is
+	// cancelled once no data arrives for timeout
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sc.url(diskKey(messageId)), nil)
+	if err != nil {
+		cancel()
+		sc.error("get", err)
+		return nil, nil, false
+	}
+	sc.sign(req, s3EmptyHash, time.Now())
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		cancel()
+		sc.error("get", err)
+		return nil, nil, false
+	}
+	resp.Body = newIdleBody(resp.Body, sc.timeout, cancel)
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			sc.error("get", errors.New(resp.Status))
+			return nil, nil, false
+		}
+		metrics.RemoteCacheRequests.With(prometheus.Labels{"result": "miss"}).Inc()
+		return nil, nil, false
+	}
+
+	expired := false
+	if expires, err := strconv.ParseInt(resp.Header.Get(s3MetaExpires), 10, 64); err == nil {
+		expired = time.Now().Unix() > expires
+	}
+
+	if expired || (cmd == "article" && resp.Header.Get(s3MetaKind) != "article") {
+		_ = resp.Body.Close()
+		metrics.RemoteCacheRequests.With(prometheus.Labels{"result": "miss"}).Inc()
+		return nil, nil, false
+	}
+
+	r := bufio.NewReader(resp.Body)
+	headers, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		_ = resp.Body.Close()
+		sc.error("get", err)
+		return nil, nil, false
+	}
+
+	metrics.RemoteCacheRequests.With(prometheus.Labels{"result": "hit"}).Inc()
+
+	return headers, &s3Reader{Reader: r, body: resp.Body}, true
+}
+
+func (sc *S3Cache) Put(messageId string, headers textproto.MIMEHeader) (CacheWriter, error) {
+	w := &s3Writer{
+		sc: sc,
+		upload: &s3Upload{
+			key:     diskKey(messageId),
+			article: headers != nil,
+		},
+	}
+
+	if err := writeHeaders(w, headers); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// enqueue schedules upload, never blocks.
+func (sc *S3Cache) enqueue(upload *s3Upload) {
+	select {
+	case sc.uploads <- upload:
+	default:
+		sc.unbuffer(len(upload.data))
+		metrics.RemoteCacheUploads.With(prometheus.Labels{"result": "dropped"}).Inc()
+	}
+}
+
+// buffer reserves n bytes for buffering an article, false means
+// buffered articles take too much memory already.
+func (sc *S3Cache) buffer(n int) bool {
+	if atomic.AddInt64(&sc.buffered, int64(n)) > sc.maxBuffered {
+		atomic.AddInt64(&sc.buffered, -int64(n))
+		return false
+	}
+	return true
+}
+
+// unbuffer releases n bytes reserved by buffer.
+func (sc *S3Cache) unbuffer(n int) {
+	atomic.AddInt64(&sc.buffered, -int64(n))
+}
+
+func (sc *S3Cache) upload() {
+	for upload := range sc.uploads {
+		err := sc.put(upload)
+		sc.unbuffer(len(upload.data))
+		if err != nil {
+			log.Printf("[s3] put %s: %v\n", upload.key, err)
+			metrics.RemoteCacheUploads.With(prometheus.Labels{"result": "error"}).Inc()
+			continue
+		}
+		metrics.RemoteCacheUploads.With(prometheus.Labels{"result": "ok"}).Inc()
+	}
+}
+
+func (sc *S3Cache) put(upload *s3Upload) error {
+	req, err := http.NewRequest(http.MethodPut, sc.url(upload.key), bytes.NewReader(upload.data))
+	if err != nil {
+		return err
+	}
+
+	kind := "body"
+	if upload.article {
+		kind = "article"
+	}
+	req.Header.Set(s3MetaKind, kind)
+	if sc.ttl > 0 {
+		req.Header.Set(s3MetaExpires, strconv.FormatInt(time.Now().Add(sc.ttl).Unix(), 10))
+	}
+
+	h := sha256.Sum256(upload.data)
+	sc.sign(req, hex.EncodeToString(h[:]), time.Now())
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
+
+func (sc *S3Cache) url(key string) string {
+	return strings.TrimSuffix(sc.config.Endpoint, "/") + "/" + sc.config.Bucket + "/" + sc.config.Prefix + key
+}
+
+func (sc *S3Cache) sign(req *http.Request, payloadHash string, now time.Time) {
+	signV4(req, sc.config.AccessKey, sc.config.SecretKey, sc.config.Region, payloadHash, now)
+}
+
+func (sc *S3Cache) error(op string, err error) {
+	log.Printf("[s3] %s: %v\n", op, err)
+	metrics.RemoteCacheRequests.With(prometheus.Labels{"result": "error"}).Inc()
+}
+
+// signV4 signs request with AWS Signature Version 4, signing host and
+// all headers set on request so far.
+func signV4(req *http.Request, accessKey string, secretKey string, region string, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSha256(key, stringToSign)),
+	))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes path the way S3 expects in canonical request.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Writer buffers article, which is queued for upload on Close. Article
+// is dropped, without failing other tiers, once buffer limit is reached.
+type s3Writer struct {
+	sc      *S3Cache
+	buf     bytes.Buffer
+	upload  *s3Upload
+	dropped bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > s3MaxObject {
+		return 0, errors.New("article is too large for remote cache")
+	}
+	if w.dropped {
+		return len(p), nil
+	}
+	if !w.sc.buffer(len(p)) {
+		w.dropped = true
+		w.Abort()
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	if w.dropped {
+		metrics.RemoteCacheUploads.With(prometheus.Labels{"result": "dropped"}).Inc()
+		return nil
+	}
+	w.upload.data = w.buf.Bytes()
+	w.sc.enqueue(w.upload)
+	return nil
+}
+
+func (w *s3Writer) Abort() {
+	w.sc.unbuffer(w.buf.Len())
+	w.buf.Reset()
+}
+
+// idleBody cancels request of a response whose body gets no data for
+// timeout, renewing the timeout on every read, so a large object is fine
+// as long as it keeps coming. Closing it releases the request.
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleBody {
+	b := &idleBody{ReadCloser: body, timeout: timeout, cancel: cancel}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, cancel)
+	}
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timer != nil {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// s3Reader reads cached object body and closes response.
+type s3Reader struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (r *s3Reader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/textproto"
+	"nntplexer/metrics"
+)
+
+const (
+	// ShardByHash spreads articles evenly by message-id hash.
+	ShardByHash = "hash"
+	// ShardByDate keeps articles posted the same day on the same disk,
+	// so that a lost disk costs a few days of articles instead of a bit
+	// of every day. Articles without known post date are sharded by hash.
+	ShardByDate = "date"
+)
+
+// ShardedCache spreads articles over several independent disks (JBOD).
+//
+// There's no redundancy, a failed disk just means cache misses for its
+// articles, which are fetched from backends again and stored on the
+// remaining disks until it's back.
+type ShardedCache struct {
+	disks   []*DiskCache
+	shardBy string
+}
+
+func NewShardedCache(disks []*DiskCache, shardBy string) *ShardedCache {
+	return &ShardedCache{
+		disks:   disks,
+		shardBy: shardBy,
+	}
+}
+
+func (sc *ShardedCache) Get(cmd string, messageId string) (textproto.MIMEHeader, io.ReadCloser, bool) {
+	// article might have been stored on any disk, e.g. while
+	// its primary one was down, so all indexes are checked
+	for _, dc := range sc.disks {
+		if headers, body, ok := dc.Get(cmd, messageId); ok {
+			return headers, body, true
+		}
+	}
+
+	metrics.CacheRequests.With(prometheus.Labels{"result": "miss"}).Inc()
+	return nil, nil, false
+}
+
+func (sc *ShardedCache) Put(messageId string, headers textproto.MIMEHeader) (CacheWriter, error) {
+	shard := sc.shard(messageId, headers)
+
+	// fall over to the next disk when the chosen one is down
+	for i := range sc.disks {
+		dc := sc.disks[(shard+i)%len(sc.disks)]
+		if dc.Up() {
+			return dc.Put(messageId, headers)
+		}
+	}
+
+	return nil, errors.New("all cache disks are down")
+}
+
+// Check verifies all disks, see DiskCache.Check.
+func (sc *ShardedCache) Check() {
+	for _, dc := range sc.disks {
+		dc.Check()
+	}
+}
+
+// Cleanup drops expired entries on all disks.
+func (sc *ShardedCache) Cleanup() {
+	for _, dc := range sc.disks {
+		dc.Cleanup()
+	}
+}
+
+func (sc *ShardedCache) shard(messageId string, headers textproto.MIMEHeader) int {
+	if sc.shardBy == ShardByDate && headers != nil {
+		if date, err := parseDate(messageId, headers); err == nil && date.Unix() > 0 {
+			return int(date.Unix()/86400) % len(sc.disks)
+		}
+	}
+
+	h := sha1.Sum([]byte(messageId))
+	return int(binary.BigEndian.Uint32(h[:4]) % uint32(len(sc.disks)))
+}
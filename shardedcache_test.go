@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestShardedCache(t *testing.T, shardBy string, n int) *ShardedCache {
+	disks := make([]*DiskCache, n)
+	for i := range disks {
+		dc, err := NewDiskCache(t.TempDir(), 0, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disks[i] = dc
+	}
+	return NewShardedCache(disks, shardBy)
+}
+
+func TestShardedCacheDiskDown(t *testing.T) {
+	sc := newTestShardedCache(t, ShardByHash, 2)
+
+	ids := []string{"<a@x>", "<b@x>", "<c@x>", "<d@x>", "<e@x>", "<f@x>"}
+	for _, id := range ids {
+		putArticle(t, sc, id, nil, id)
+	}
+
+	// hash spreads articles over both disks
+	if sc.disks[0].lru.Len() == 0 || sc.disks[1].lru.Len() == 0 {
+		t.Fatalf("articles not spread: %d/%d", sc.disks[0].lru.Len(), sc.disks[1].lru.Len())
+	}
+
+	// disk disappears leaving an empty mount point
+	lost := sc.disks[0]
+	if err := os.Remove(filepath.Join(lost.dir, diskMarker)); err != nil {
+		t.Fatal(err)
+	}
+	sc.Check()
+
+	if lost.Up() || lost.lru.Len() != 0 {
+		t.Fatal("lost disk is still in use")
+	}
+
+	// its articles are misses now and are stored on the remaining disk
+	for _, id := range ids {
+		if _, _, ok := getArticle(t, sc, "body", id); !ok {
+			putArticle(t, sc, id, nil, id)
+		}
+		if _, body, ok := getArticle(t, sc, "body", id); !ok || body != id {
+			t.Fatalf("%s not served after re-fetch", id)
+		}
+	}
+
+	// disk is back with whatever it had stored
+	f, err := os.Create(filepath.Join(lost.dir, diskMarker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	sc.Check()
+
+	if !lost.Up() || lost.lru.Len() == 0 {
+		t.Fatal("disk not reloaded after coming back")
+	}
+}
+
+func TestShardedCacheByDate(t *testing.T) {
+	sc := newTestShardedCache(t, ShardByDate, 3)
+
+	date := textproto.MIMEHeader{"Date": {"Mon, 2 Jan 2006 15:04:05 -0700"}}
+	for _, id := range []string{"<a@x>", "<b@x>", "<c@x>", "<d@x>"} {
+		putArticle(t, sc, id, date, "body")
+	}
+
+	// articles posted the same day share a disk
+	stored := 0
+	for _, dc := range sc.disks {
+		if dc.lru.Len() > 0 {
+			stored++
+		}
+	}
+	if stored != 1 {
+		t.Fatalf("same day articles spread over %d disks", stored)
+	}
+}